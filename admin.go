@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"github.com/tensei/unrustlelogs/redact"
+)
+
+const adminPageSize = 25
+
+// adminStatusOpen filters for every request that isn't finished yet.
+const adminStatusOpen = "open"
+
+// AdminFilter are the filters of the request list, taken from the query string.
+type AdminFilter struct {
+	Service string `form:"service"`
+	Status  string `form:"status"`
+	Name    string `form:"name"`
+	Email   string `form:"email"`
+	From    string `form:"from"`
+	To      string `form:"to"`
+	User    string `form:"user"`
+	Page    int    `form:"page"`
+}
+
+// query returns the filter as query string with the given page.
+func (f AdminFilter) query(page int) string {
+	v := url.Values{}
+	for k, s := range map[string]string{
+		"service": f.Service,
+		"status":  f.Status,
+		"name":    f.Name,
+		"email":   f.Email,
+		"from":    f.From,
+		"to":      f.To,
+		"user":    f.User,
+	} {
+		if s != "" {
+			v.Set(k, s)
+		}
+	}
+	if page > 1 {
+		v.Set("page", strconv.Itoa(page))
+	}
+	return v.Encode()
+}
+
+// auditQuery is query without the search terms, the audit log outlives a
+// forgotten user so it only records which of them were used.
+func (f AdminFilter) auditQuery() string {
+	for _, s := range []*string{&f.Name, &f.Email, &f.User} {
+		if *s != "" {
+			*s = "set"
+		}
+	}
+	return f.query(f.Page)
+}
+
+// AdminRequestRow is a request joined with the user that made it.
+type AdminRequestRow struct {
+	DeletionRequest
+	Service     string
+	Name        string
+	DisplayName string
+	UserEmail   string
+}
+
+// AdminRequestsPayload ...
+type AdminRequestsPayload struct {
+	Filter   AdminFilter
+	Requests []AdminRequestRow
+	Total    int
+	Page     int
+	Pages    int
+	PrevURL  string
+	NextURL  string
+	Services []string
+	Statuses []RequestStatus
+	// CanViewEmail hides emails from staff without the permission
+	CanViewEmail bool
+}
+
+// AdminRequestPayload ...
+type AdminRequestPayload struct {
+	Request *DeletionRequest
+	User    *User
+	// Linked are all identities of the person, including User
+	Linked    []*User
+	History   []RequestTransition
+	Aliases   []IdentityAlias
+	Windows   []OwnershipWindow
+	Conflicts []OwnershipConflict
+	Policy    PolicyDecision
+	Flags     []FraudFlag
+	// Sessions are the active logins of the person
+	Sessions []Session
+	Actions  []string
+	Error    string
+
+	CanViewEmail bool
+	CanRedact    bool
+	Redacting    bool
+	// CanRevokeSessions shows the button that logs the requester out
+	CanRevokeSessions bool
+	CSRF              string
+}
+
+var allStatuses = []RequestStatus{
+	StatusSubmitted,
+	StatusIdentityVerified,
+	StatusApproved,
+	StatusProcessing,
+	StatusCompleted,
+	StatusRejected,
+	StatusWithdrawn,
+}
+
+// adminActions maps the actions staff can take on a request to the status
+// they move it to.
+var adminActions = map[string]RequestStatus{
+	"verify":   StatusIdentityVerified,
+	"approve":  StatusApproved,
+	"reject":   StatusRejected,
+	"complete": StatusCompleted,
+}
+
+// staffActor returns who is acting on the admin pages.
+func (ur *UnRustleLogs) staffActor(c *gin.Context) Actor {
+	if s, ok := ur.currentStaff(c); ok {
+		return ur.actor(c, s.Actor())
+	}
+	return ur.actor(c, "unknown")
+}
+
+// filterRequests applies the filter to a query of requests joined with users.
+func filterRequests(q *gorm.DB, f AdminFilter) *gorm.DB {
+	if f.Service != "" {
+		q = q.Where("users.service = ?", f.Service)
+	}
+	switch f.Status {
+	case "":
+	case adminStatusOpen:
+		q = q.Where("deletion_requests.status in (?)", openStatuses())
+	default:
+		q = q.Where("deletion_requests.status = ?", f.Status)
+	}
+	if name := strings.ToLower(strings.TrimSpace(f.Name)); name != "" {
+		like := "%" + name + "%"
+		q = q.Where("lower(users.name) like ? or lower(users.display_name) like ?", like, like)
+	}
+	if email := strings.ToLower(strings.TrimSpace(f.Email)); email != "" {
+		like := "%" + email + "%"
+		q = q.Where("lower(users.email) like ? or lower(deletion_requests.email) like ?", like, like)
+	}
+	if t, err := time.Parse("2006-01-02", f.From); err == nil {
+		q = q.Where("deletion_requests.created_at >= ?", t)
+	}
+	if t, err := time.Parse("2006-01-02", f.To); err == nil {
+		q = q.Where("deletion_requests.created_at < ?", t.AddDate(0, 0, 1))
+	}
+	if f.User != "" {
+		q = q.Where("deletion_requests.user_id = ?", f.User)
+	}
+	return q
+}
+
+func (ur *UnRustleLogs) adminRequestsHandler(c *gin.Context) {
+	var f AdminFilter
+	if err := c.ShouldBindQuery(&f); err != nil {
+		c.String(http.StatusBadRequest, "invalid filter")
+		return
+	}
+	if f.Page < 1 {
+		f.Page = 1
+	}
+	canViewEmail := ur.staffCan(c, PermViewEmail)
+	if !canViewEmail {
+		f.Email = ""
+	}
+
+	q := filterRequests(ur.db.Table("deletion_requests").
+		Joins("left join users on users.id = deletion_requests.user_id"), f)
+
+	payload := AdminRequestsPayload{
+		Filter:   f,
+		Page:     f.Page,
+		Services: ur.providerServices(),
+		Statuses: allStatuses,
+
+		CanViewEmail: canViewEmail,
+	}
+	if err := q.Count(&payload.Total).Error; err != nil {
+		logrus.Error(err)
+	}
+	payload.Pages = (payload.Total + adminPageSize - 1) / adminPageSize
+	err := q.Select("deletion_requests.*, " +
+		// users that asked to be forgotten are gone
+		"coalesce(users.service, '') as service, coalesce(users.name, '') as name, " +
+		"coalesce(users.display_name, '') as display_name, coalesce(users.email, '') as user_email").
+		Order("deletion_requests.created_at desc").
+		Offset((f.Page - 1) * adminPageSize).
+		Limit(adminPageSize).
+		Scan(&payload.Requests).Error
+	if err != nil {
+		logrus.Error(err)
+	}
+	if f.Page > 1 {
+		payload.PrevURL = "/admin/requests?" + f.query(f.Page-1)
+	}
+	if f.Page < payload.Pages {
+		payload.NextURL = "/admin/requests?" + f.query(f.Page+1)
+	}
+	if canViewEmail && len(payload.Requests) > 0 {
+		ids := make([]string, len(payload.Requests))
+		for i, r := range payload.Requests {
+			ids[i] = r.ID
+		}
+		ur.audit(ur.staffActor(c), AuditPIIList, "requests", f.auditQuery()+" "+strings.Join(ids, ","))
+	}
+	c.HTML(http.StatusOK, "admin_requests.tmpl", payload)
+}
+
+// adminRequestPayload loads everything the detail page shows, only the
+// actions the staff member is allowed to take are included.
+func (ur *UnRustleLogs) adminRequestPayload(c *gin.Context, id string) (*AdminRequestPayload, bool) {
+	r, ok := ur.GetDeletionRequest(id)
+	if !ok {
+		return nil, false
+	}
+	payload := &AdminRequestPayload{
+		Request: r,
+		History: ur.RequestHistory(r.ID),
+		CSRF:    csrfToken(c),
+	}
+	if user, ok := ur.GetUser(r.UserID); ok {
+		payload.User = user
+		payload.Linked = ur.LinkedUsers(user)
+		for _, linked := range payload.Linked {
+			payload.Aliases = append(payload.Aliases, ur.Aliases(linked.Service, linked.UserID)...)
+		}
+		payload.Windows, payload.Conflicts = ur.PersonWindows(user)
+		payload.Sessions = ur.UserSessions(user)
+	}
+	payload.Policy = ur.EvaluatePolicy(r)
+	// a failure already blocks the policy decision shown next to the flags
+	flags, err := ur.FraudFlags(r)
+	if err != nil {
+		logrus.Error(err)
+	}
+	payload.Flags = flags
+	for _, name := range []string{"verify", "approve", "reject", "complete"} {
+		if r.Status.CanTransition(adminActions[name]) && ur.staffCan(c, actionPermissions[name]) {
+			payload.Actions = append(payload.Actions, name)
+		}
+	}
+	payload.CanViewEmail = ur.staffCan(c, PermViewEmail)
+	if !payload.CanViewEmail {
+		for i := range payload.Aliases {
+			if payload.Aliases[i].Kind == AliasEmail {
+				payload.Aliases[i].Value = "hidden"
+			}
+		}
+		for i := range payload.Sessions {
+			payload.Sessions[i].ClientIP = "hidden"
+			payload.Sessions[i].UserAgent = "hidden"
+		}
+	}
+	payload.CanRevokeSessions = len(payload.Sessions) > 0 && ur.staffCan(c, PermRevokeSessions)
+	payload.Redacting = r.Status == StatusProcessing
+	payload.CanRedact = ur.config.Logs.Path != "" &&
+		(r.Status == StatusApproved || r.Status == StatusProcessing) &&
+		ur.staffCan(c, PermRunRedaction)
+	return payload, true
+}
+
+func (ur *UnRustleLogs) adminRequestHandler(c *gin.Context) {
+	payload, ok := ur.adminRequestPayload(c, c.Param("id"))
+	if !ok {
+		c.String(http.StatusNotFound, "request not found")
+		return
+	}
+	if payload.CanViewEmail && payload.User != nil {
+		ur.audit(ur.staffActor(c), AuditPIIView, "request:"+payload.Request.ID, "user:"+payload.User.ID)
+	}
+	c.HTML(http.StatusOK, "admin_request.tmpl", payload)
+}
+
+func (ur *UnRustleLogs) adminRequestActionHandler(c *gin.Context) {
+	id := c.Param("id")
+	action := c.Param("action")
+	perm, ok := actionPermissions[action]
+	if !ok {
+		c.String(http.StatusNotFound, "unknown action")
+		return
+	}
+	if !ur.staffCan(c, perm) {
+		c.String(http.StatusForbidden, "you are missing the %q permission", perm)
+		return
+	}
+
+	var err error
+	switch action {
+	case "redact":
+		err = ur.startRedaction(c, id)
+	case "revoke-sessions":
+		err = ur.revokeRequesterSessions(c, id)
+	default:
+		_, err = ur.TransitionRequest(id, adminActions[action], ur.staffActor(c), strings.TrimSpace(c.PostForm("note")))
+	}
+	if err != nil {
+		if err != ErrInvalidTransition && !gorm.IsRecordNotFoundError(err) {
+			logrus.Error(err)
+		}
+		payload, ok := ur.adminRequestPayload(c, id)
+		if !ok {
+			c.String(http.StatusNotFound, "request not found")
+			return
+		}
+		payload.Error = fmt.Sprintf("can't %s this request: %v", action, err)
+		c.HTML(http.StatusConflict, "admin_request.tmpl", payload)
+		return
+	}
+	c.Redirect(http.StatusFound, "/admin/requests/"+id)
+}
+
+// revokeRequesterSessions logs the requester out everywhere.
+func (ur *UnRustleLogs) revokeRequesterSessions(c *gin.Context, id string) error {
+	r, ok := ur.GetDeletionRequest(id)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	user, ok := ur.GetUser(r.UserID)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	reason := "revoked by staff"
+	if note := strings.TrimSpace(c.PostForm("note")); note != "" {
+		reason += ": " + note
+	}
+	_, err := ur.RevokeSessions(ur.staffActor(c), user, reason)
+	return err
+}
+
+// startRedaction runs the redaction of an approved request in the background,
+// the outcome ends up in the request history.
+func (ur *UnRustleLogs) startRedaction(c *gin.Context, id string) error {
+	r, ok := ur.GetDeletionRequest(id)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if r.Status != StatusApproved {
+		return ErrInvalidTransition
+	}
+	job := redactJob{
+		Request: r,
+		Actor:   ur.staffActor(c),
+		Logs:    ur.config.Logs.Path,
+	}
+	if c.PostForm("mask") != "" {
+		job.Mode = redact.Mask
+	}
+	// refuse right away instead of failing in the background
+	user, ok := ur.GetUser(r.UserID)
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	if _, conflicts := ur.PersonWindows(user); len(conflicts) > 0 {
+		return fmt.Errorf("%d name ownership conflicts need a manual review", len(conflicts))
+	}
+	go func() {
+		if _, err := ur.runRedaction(job); err != nil {
+			logrus.Errorf("redacting request %s: %v", r.ID, err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// alias kinds
+const (
+	AliasName        = "name"
+	AliasDisplayName = "display_name"
+	AliasNick        = "nick"
+	AliasEmail       = "email"
+	// AliasChat followed by a service is a name proven in the chat of that
+	// service, which isn't the service of the identity it's stored on
+	AliasChat = "chat:"
+)
+
+// IdentityAlias is a name or email that was seen for a provider account,
+// renames add new aliases instead of replacing the old ones.
+type IdentityAlias struct {
+	ID uint `gorm:"primary_key"`
+
+	Service   string `gorm:"index:idx_alias_identity"`
+	UserID    string `gorm:"index:idx_alias_identity"`
+	Kind      string
+	Value     string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// aliasService is the service whose names the alias competes with.
+func aliasService(a IdentityAlias) string {
+	if strings.HasPrefix(a.Kind, AliasChat) {
+		return strings.TrimPrefix(a.Kind, AliasChat)
+	}
+	return a.Service
+}
+
+// aliasValues returns the aliases currently stored on the user by kind.
+func aliasValues(u *User) map[string]string {
+	return map[string]string{
+		AliasName:        u.Name,
+		AliasDisplayName: u.DisplayName,
+		AliasNick:        u.Nick,
+		AliasEmail:       u.Email,
+	}
+}
+
+// recordAliases adds or refreshes the aliases of the user as seen at time seen.
+func recordAliases(tx *gorm.DB, u *User, seen time.Time) error {
+	for kind, value := range aliasValues(u) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		var a IdentityAlias
+		err := tx.Where("service = ? and user_id = ? and kind = ? and value = ?", u.Service, u.UserID, kind, value).First(&a).Error
+		if gorm.IsRecordNotFoundError(err) {
+			err = tx.Create(&IdentityAlias{
+				Service:   u.Service,
+				UserID:    u.UserID,
+				Kind:      kind,
+				Value:     value,
+				FirstSeen: seen,
+				LastSeen:  seen,
+			}).Error
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if seen.After(a.LastSeen) {
+			if err := tx.Model(&a).Update("last_seen", seen).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Aliases returns every alias seen for the provider account, oldest first.
+func (ur *UnRustleLogs) Aliases(service, userID string) []IdentityAlias {
+	var aliases []IdentityAlias
+	ur.db.Where("service = ? and user_id = ?", service, userID).Order("first_seen asc").Find(&aliases)
+	return aliases
+}
+
+// AliasNames returns every name the user has been seen with, these are the
+// names that can show up in the logs.
+func (ur *UnRustleLogs) AliasNames(u *User) []string {
+	var names []string
+	seen := map[string]struct{}{}
+	add := func(n string) {
+		k := strings.ToLower(strings.TrimSpace(n))
+		if k == "" {
+			return
+		}
+		if _, ok := seen[k]; ok {
+			return
+		}
+		seen[k] = struct{}{}
+		names = append(names, n)
+	}
+	add(u.Name)
+	add(u.DisplayName)
+	add(u.Nick)
+	for _, a := range ur.Aliases(u.Service, u.UserID) {
+		if a.Kind != AliasEmail {
+			add(a.Value)
+		}
+	}
+	return names
+}
+
+// backfillAliases records the current names of users that were created
+// before aliases were tracked.
+func (ur *UnRustleLogs) backfillAliases() error {
+	var users []User
+	if err := ur.db.Find(&users).Error; err != nil {
+		return err
+	}
+	for i := range users {
+		u := &users[i]
+		var count int
+		ur.db.Model(&IdentityAlias{}).Where("service = ? and user_id = ?", u.Service, u.UserID).Count(&count)
+		if count > 0 {
+			continue
+		}
+		err := ur.transaction(func(tx *gorm.DB) error {
+			if err := recordAliases(tx, u, u.CreatedAt); err != nil {
+				return err
+			}
+			return recordAliases(tx, u, u.UpdatedAt)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// audit actions
+const (
+	AuditLogin             = "login"
+	AuditPIIView           = "pii.view"
+	AuditPIIList           = "pii.list"
+	AuditRequestCreate     = "request.create"
+	AuditRequestTransition = "request.transition"
+	AuditRedactionRun      = "redaction.run"
+	AuditRoleGrant         = "role.grant"
+	AuditRoleRevoke        = "role.revoke"
+	AuditConfigRoleGrant   = "role.config.grant"
+	AuditConfigRoleRevoke  = "role.config.revoke"
+	AuditExport            = "audit.export"
+	AuditUserForget        = "user.forget"
+	AuditIdentityLink      = "identity.link"
+	AuditTokenRevoke       = "token.revoke"
+	AuditChatProof         = "chat.proof"
+	AuditKeyAdd            = "key.add"
+	AuditKeyRetire         = "key.retire"
+	AuditKeyRemove         = "key.remove"
+	AuditSessionRevoke     = "session.revoke"
+)
+
+// Actor is who did something and from where.
+type Actor struct {
+	Name      string
+	IP        string
+	RequestID string
+}
+
+// cliActor is used for everything done through the command line.
+var cliActor = Actor{Name: "cli", RequestID: "cli"}
+
+// actor returns an Actor for name acting through the request c.
+func (ur *UnRustleLogs) actor(c *gin.Context, name string) Actor {
+	a := Actor{Name: name}
+	if c != nil {
+		a.IP = clientIP(c)
+		a.RequestID = c.GetString("request_id")
+	}
+	return a
+}
+
+// AuditEntry is one entry of the append-only audit log, every entry hashes
+// the previous one so edits and deletions break the chain.
+type AuditEntry struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	Action    string `json:"action"`
+	Actor     string `json:"actor"`
+	IP        string `json:"ip"`
+	RequestID string `json:"request_id"`
+	Subject   string `json:"subject"`
+	Details   string `json:"details"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// ConfigRole mirrors the staff roles of the config file, it's only used to
+// notice config changes between restarts.
+type ConfigRole struct {
+	ID      uint `gorm:"primary_key"`
+	Service string
+	UserID  string
+	Role    Role
+}
+
+// computeHash hashes every field of the entry except Hash itself.
+func (e *AuditEntry) computeHash() string {
+	h := sha256.New()
+	for _, s := range []string{
+		strconv.FormatUint(uint64(e.ID), 10),
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		e.Action,
+		e.Actor,
+		e.IP,
+		e.RequestID,
+		e.Subject,
+		e.Details,
+		e.PrevHash,
+	} {
+		// length prefix so fields can't be shifted into each other
+		fmt.Fprintf(h, "%d:%s|", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// requestIDMiddleware tags every request with an id that ends up in the audit log.
+func requestIDMiddleware(c *gin.Context) {
+	id, err := uuid.NewRandom()
+	if err == nil {
+		c.Set("request_id", id.String())
+		c.Header("X-Request-ID", id.String())
+	}
+	c.Next()
+}
+
+// audit appends an entry to the audit log, failures are logged since the
+// action itself already happened.
+func (ur *UnRustleLogs) audit(actor Actor, action, subject, details string) {
+	ur.auditMutex.Lock()
+	defer ur.auditMutex.Unlock()
+	if err := ur.appendAudit(ur.db, actor, action, subject, details); err != nil {
+		logrus.Errorf("audit %s %s: %v", action, subject, err)
+	}
+}
+
+// auditTransaction runs fn in a transaction that appends to the audit log.
+// The log stays locked until the transaction commits, another append would
+// otherwise read the same last entry and fork the chain.
+func (ur *UnRustleLogs) auditTransaction(fn func(tx *gorm.DB) error) error {
+	ur.auditMutex.Lock()
+	defer ur.auditMutex.Unlock()
+	return ur.transaction(fn)
+}
+
+// appendAudit appends an entry using db, which may be a running transaction.
+// The caller holds auditMutex, see audit and auditTransaction.
+func (ur *UnRustleLogs) appendAudit(db *gorm.DB, actor Actor, action, subject, details string) error {
+	var last AuditEntry
+	err := db.Order("id desc").First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	e := &AuditEntry{
+		ID: last.ID + 1,
+		// sqlite keeps microseconds reliably, the hash has to survive a round trip
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+		Action:    action,
+		Actor:     actor.Name,
+		IP:        actor.IP,
+		RequestID: actor.RequestID,
+		Subject:   subject,
+		Details:   details,
+		PrevHash:  last.Hash,
+	}
+	e.Hash = e.computeHash()
+	return db.Create(e).Error
+}
+
+// VerifyAudit walks the whole audit log and returns an error describing the
+// first entry that was changed, removed or inserted. Removing entries from the
+// end can't be detected from the chain alone, so the last valid entry is
+// returned to be compared with earlier exports.
+func (ur *UnRustleLogs) VerifyAudit() (int, *AuditEntry, error) {
+	rows, err := ur.db.Model(&AuditEntry{}).Order("id asc").Rows()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var prev AuditEntry
+	count := 0
+	for rows.Next() {
+		var e AuditEntry
+		if err := ur.db.ScanRows(rows, &e); err != nil {
+			return count, &prev, err
+		}
+		if e.ID != prev.ID+1 {
+			return count, &prev, fmt.Errorf("entry %d follows %d, entries are missing", e.ID, prev.ID)
+		}
+		if e.PrevHash != prev.Hash {
+			return count, &prev, fmt.Errorf("entry %d doesn't link to entry %d", e.ID, prev.ID)
+		}
+		if e.computeHash() != e.Hash {
+			return count, &prev, fmt.Errorf("entry %d was modified", e.ID)
+		}
+		prev = e
+		count++
+	}
+	return count, &prev, rows.Err()
+}
+
+// ExportAudit writes the audit log as json lines.
+func (ur *UnRustleLogs) ExportAudit(w io.Writer) error {
+	rows, err := ur.db.Model(&AuditEntry{}).Order("id asc").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		var e AuditEntry
+		if err := ur.db.ScanRows(rows, &e); err != nil {
+			return err
+		}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// syncConfigRoles audits roles that were added to or removed from the
+// config file since the last start.
+func (ur *UnRustleLogs) syncConfigRoles() error {
+	current := map[ConfigRole]bool{}
+	for _, s := range ur.config.Staff {
+		current[ConfigRole{Service: s.Service, UserID: s.UserID, Role: Role(s.Role)}] = true
+	}
+	return ur.auditTransaction(func(tx *gorm.DB) error {
+		var stored []ConfigRole
+		if err := tx.Find(&stored).Error; err != nil {
+			return err
+		}
+		known := map[ConfigRole]bool{}
+		for _, r := range stored {
+			key := ConfigRole{Service: r.Service, UserID: r.UserID, Role: r.Role}
+			known[key] = true
+			if current[key] {
+				continue
+			}
+			if err := tx.Delete(&r).Error; err != nil {
+				return err
+			}
+			if err := ur.appendAudit(tx, Actor{Name: "config"}, AuditConfigRoleRevoke, staffSubject(r.Service, r.UserID), string(r.Role)); err != nil {
+				return err
+			}
+		}
+		for r := range current {
+			if known[r] {
+				continue
+			}
+			r := r
+			if err := tx.Create(&r).Error; err != nil {
+				return err
+			}
+			if err := ur.appendAudit(tx, Actor{Name: "config"}, AuditConfigRoleGrant, staffSubject(r.Service, r.UserID), string(r.Role)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func staffSubject(service, userID string) string {
+	return fmt.Sprintf("identity:%s:%s", service, userID)
+}
+
+func (ur *UnRustleLogs) auditExportHandler(c *gin.Context) {
+	ur.audit(ur.staffActor(c), AuditExport, "audit", "")
+	c.Header("Content-Disposition", "attachment; filename=audit.jsonl")
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	if err := ur.ExportAudit(c.Writer); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (ur *UnRustleLogs) auditExportCommand(args []string) error {
+	fs := flag.NewFlagSet("audit-export", flag.ContinueOnError)
+	out := fs.String("o", "", "file to write to, defaults to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	ur.audit(cliActor, AuditExport, "audit", strings.TrimSpace(*out))
+	bw := bufio.NewWriter(w)
+	if err := ur.ExportAudit(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (ur *UnRustleLogs) verifyAuditCommand(args []string) error {
+	count, last, err := ur.VerifyAudit()
+	if err != nil {
+		return fmt.Errorf("audit log is tampered after %d valid entries: %v", count, err)
+	}
+	fmt.Printf("audit log ok, %d entries, last entry %d hash %s\n", count, last.ID, last.Hash)
+	return nil
+}
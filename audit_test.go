@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+// testRustle returns an instance backed by a fresh in-memory database.
+func testRustle(t *testing.T, models ...interface{}) *UnRustleLogs {
+	t.Helper()
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would get its own empty database
+	db.DB().SetMaxOpenConns(1)
+	if err := db.AutoMigrate(models...).Error; err != nil {
+		t.Fatal(err)
+	}
+	ur := NewUnRustleLogs()
+	ur.config = &Config{}
+	ur.db = db
+	return ur
+}
+
+func TestVerifyAudit(t *testing.T) {
+	tests := []struct {
+		name string
+		// tamper changes the log of four entries behind the app's back
+		tamper func(db *gorm.DB) error
+		count  int
+		last   uint
+		err    string
+	}{
+		{
+			name:   "untouched",
+			tamper: func(db *gorm.DB) error { return nil },
+			count:  4,
+			last:   4,
+		},
+		{
+			name: "details changed",
+			tamper: func(db *gorm.DB) error {
+				return db.Exec("update audit_entries set details = ? where id = 2", "nothing happened").Error
+			},
+			count: 1,
+			last:  1,
+			err:   "entry 2 was modified",
+		},
+		{
+			name: "hash recomputed after a change",
+			tamper: func(db *gorm.DB) error {
+				var e AuditEntry
+				if err := db.Where("id = 2").First(&e).Error; err != nil {
+					return err
+				}
+				e.Actor = "someone else"
+				e.Hash = e.computeHash()
+				return db.Save(&e).Error
+			},
+			count: 2,
+			last:  2,
+			err:   "entry 3 doesn't link to entry 2",
+		},
+		{
+			name: "entry removed",
+			tamper: func(db *gorm.DB) error {
+				return db.Exec("delete from audit_entries where id = 3").Error
+			},
+			count: 2,
+			last:  2,
+			err:   "entry 4 follows 2, entries are missing",
+		},
+		{
+			name: "entry appended outside the chain",
+			tamper: func(db *gorm.DB) error {
+				e := AuditEntry{ID: 5, Action: AuditLogin, Actor: "user:x"}
+				e.Hash = e.computeHash()
+				return db.Create(&e).Error
+			},
+			count: 4,
+			last:  4,
+			err:   "entry 5 doesn't link to entry 4",
+		},
+		{
+			// only an earlier export can tell, the last entry is returned
+			// to compare with it
+			name: "end truncated",
+			tamper: func(db *gorm.DB) error {
+				return db.Exec("delete from audit_entries where id = 4").Error
+			},
+			count: 3,
+			last:  3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ur := testRustle(t, &AuditEntry{})
+			for _, subject := range []string{"request:1", "request:2", "user:1", "user:2"} {
+				if err := ur.appendAudit(ur.db, Actor{Name: "staff"}, AuditRequestTransition, subject, "approved"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tt.tamper(ur.db); err != nil {
+				t.Fatal(err)
+			}
+			count, last, err := ur.VerifyAudit()
+			if count != tt.count || last.ID != tt.last {
+				t.Errorf("verified %d entries up to %d, want %d up to %d", count, last.ID, tt.count, tt.last)
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error is %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// challenge codes look like UR-7KQ2XD, the prefix keeps the database out
+	// of every other chat message
+	chatCodePrefix = "UR-"
+	chatCodeChars  = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	defaultTwitchIRC        = "ircs://irc.chat.twitch.tv"
+	defaultChallengeMinutes = 10
+
+	chatReconnectMin = time.Second * 5
+	chatReconnectMax = time.Minute
+)
+
+var (
+	errChatUnknown  = errors.New("that chat isn't watched")
+	errChatName     = errors.New("that isn't a valid chat name")
+	errChatVerified = errors.New("the request is already verified")
+	chatNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,32}$`)
+)
+
+// challengeErrors are the messages the provider page shows for the
+// ?challenge= codes, anything else in the query is ignored.
+var challengeErrors = map[string]string{
+	"unknown":  errChatUnknown.Error(),
+	"name":     errChatName.Error(),
+	"verified": errChatVerified.Error(),
+	"failed":   "the challenge couldn't be created, please try again",
+}
+
+// ChatConfig enables proving an identity by posting a code in a chat we log.
+type ChatConfig struct {
+	// TwitchChannel is the channel to watch, empty disables twitch chat
+	TwitchChannel string `toml:"twitch_channel"`
+	// TwitchIRC is an irc:// or ircs:// url
+	TwitchIRC string `toml:"twitch_irc"`
+	// DestinyggWebsocket is the ws:// or wss:// url of the chat, empty
+	// disables destiny.gg chat
+	DestinyggWebsocket string `toml:"destinygg_websocket"`
+	ChallengeMinutes   int    `toml:"challenge_minutes"`
+}
+
+// ChatChallenge asks a requester to post Code as Name in Chat.
+type ChatChallenge struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	RequestID  string `gorm:"index"`
+	UserID     string
+	Chat       string
+	Name       string
+	Code       string `gorm:"index"`
+	ExpiresAt  time.Time
+	VerifiedAt *time.Time
+}
+
+// Expired reports whether the challenge can't be completed anymore.
+func (ch *ChatChallenge) Expired() bool {
+	return ch.VerifiedAt == nil && time.Now().After(ch.ExpiresAt)
+}
+
+// ChatInfo describes a watched chat for templates.
+type ChatInfo struct {
+	Chat  string
+	Title string
+}
+
+// chats returns every chat that is configured.
+func (ur *UnRustleLogs) chats() []ChatInfo {
+	var chats []ChatInfo
+	if ur.config.Chat.TwitchChannel != "" {
+		chats = append(chats, ChatInfo{TWITCHSERVICE, "Twitch chat #" + strings.ToLower(ur.config.Chat.TwitchChannel)})
+	}
+	if ur.config.Chat.DestinyggWebsocket != "" {
+		chats = append(chats, ChatInfo{DESTINYGGSERVICE, "Destiny.gg chat"})
+	}
+	return chats
+}
+
+func (ur *UnRustleLogs) chatTitle(chat string) (string, bool) {
+	for _, c := range ur.chats() {
+		if c.Chat == chat {
+			return c.Title, true
+		}
+	}
+	return "", false
+}
+
+// IssueChatChallenge replaces any pending challenge of the request with a new
+// one for name in chat.
+func (ur *UnRustleLogs) IssueChatChallenge(user *User, r *DeletionRequest, chat, name string) (*ChatChallenge, error) {
+	if _, ok := ur.chatTitle(chat); !ok {
+		return nil, errChatUnknown
+	}
+	name = strings.TrimSpace(name)
+	if !chatNamePattern.MatchString(name) {
+		return nil, errChatName
+	}
+	if r.Status != StatusSubmitted {
+		return nil, errChatVerified
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	minutes := ur.config.Chat.ChallengeMinutes
+	if minutes <= 0 {
+		minutes = defaultChallengeMinutes
+	}
+	ch := &ChatChallenge{
+		ID:        id.String(),
+		RequestID: r.ID,
+		UserID:    user.ID,
+		Chat:      chat,
+		Name:      name,
+		Code:      chatCodePrefix + uniuri.NewLenChars(6, []byte(chatCodeChars)),
+		ExpiresAt: time.Now().Add(time.Duration(minutes) * time.Minute),
+	}
+	err = ur.transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("request_id = ? and verified_at is null", r.ID).Delete(&ChatChallenge{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(ch).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// PendingChatChallenge returns the latest challenge of the request.
+func (ur *UnRustleLogs) PendingChatChallenge(requestID string) (*ChatChallenge, bool) {
+	var ch ChatChallenge
+	ur.db.Where("request_id = ?", requestID).Order("created_at desc").First(&ch)
+	return &ch, ch.ID != ""
+}
+
+// VerifiedChatChallenge returns the challenge that proved the request, if any.
+func (ur *UnRustleLogs) VerifiedChatChallenge(requestID string) (*ChatChallenge, bool) {
+	var ch ChatChallenge
+	ur.db.Where("request_id = ? and verified_at is not null", requestID).First(&ch)
+	return &ch, ch.ID != ""
+}
+
+// chatMessage checks a message posted by nick in chat against the pending
+// challenges.
+func (ur *UnRustleLogs) chatMessage(chat, nick, text string) {
+	if !strings.Contains(text, chatCodePrefix) {
+		return
+	}
+	for _, word := range strings.Fields(text) {
+		if !strings.HasPrefix(word, chatCodePrefix) {
+			continue
+		}
+		var ch ChatChallenge
+		err := ur.db.Where("code = ? and chat = ? and verified_at is null and expires_at > ?", word, chat, time.Now()).First(&ch).Error
+		if err != nil {
+			continue
+		}
+		// the code alone isn't enough, the name has to post it
+		if !strings.EqualFold(ch.Name, nick) {
+			continue
+		}
+		if err := ur.completeChatChallenge(&ch); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// completeChatChallenge records the proof, remembers the name for the
+// request and verifies it.
+func (ur *UnRustleLogs) completeChatChallenge(ch *ChatChallenge) error {
+	title, _ := ur.chatTitle(ch.Chat)
+	// the name stays on the challenge, forgetting the user can't erase notes
+	note := "posted the challenge code in " + title
+	actor := Actor{Name: "chat", RequestID: "chat"}
+	err := ur.auditTransaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		res := tx.Model(&ChatChallenge{}).Where("id = ? and verified_at is null", ch.ID).Update("verified_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+		var u User
+		if err := tx.Where("id = ?", ch.UserID).First(&u).Error; err != nil {
+			return err
+		}
+		// the name may not be known yet, ownership windows will ask staff
+		// to review the time before the proof. a name from another service's
+		// chat keeps that service so it's compared against its accounts
+		q := tx.Model(&IdentityAlias{}).Where("service = ? and user_id = ? and lower(value) = ?", u.Service, u.UserID, strings.ToLower(ch.Name))
+		kind := AliasNick
+		if ch.Chat == u.Service {
+			q = q.Where("kind <> ? and kind not like ?", AliasEmail, AliasChat+"%")
+		} else {
+			kind = AliasChat + ch.Chat
+			q = q.Where("kind = ?", kind)
+		}
+		var count int
+		if err := q.Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			err := tx.Create(&IdentityAlias{
+				Service:   u.Service,
+				UserID:    u.UserID,
+				Kind:      kind,
+				Value:     ch.Name,
+				FirstSeen: now,
+				LastSeen:  now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return ur.appendAudit(tx, actor, AuditChatProof, "request:"+ch.RequestID, note)
+	})
+	if err != nil {
+		return err
+	}
+	if r, ok := ur.GetDeletionRequest(ch.RequestID); ok && r.Status == StatusSubmitted {
+		if _, err := ur.TransitionRequest(r.ID, StatusIdentityVerified, actor, note); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchChats follows every configured chat until ctx is done.
+func (ur *UnRustleLogs) watchChats(ctx context.Context) {
+	if ch := ur.config.Chat.TwitchChannel; ch != "" {
+		addr := ur.config.Chat.TwitchIRC
+		if addr == "" {
+			addr = defaultTwitchIRC
+		}
+		go ur.keepWatching(ctx, "twitch chat", func(ctx context.Context) error {
+			return watchIRC(ctx, addr, ch, func(nick, text string) {
+				ur.chatMessage(TWITCHSERVICE, nick, text)
+			})
+		})
+	}
+	if addr := ur.config.Chat.DestinyggWebsocket; addr != "" {
+		go ur.keepWatching(ctx, "destiny.gg chat", func(ctx context.Context) error {
+			return watchDestinyggChat(ctx, addr, func(nick, text string) {
+				ur.chatMessage(DESTINYGGSERVICE, nick, text)
+			})
+		})
+	}
+}
+
+// keepWatching reconnects watch with backoff whenever it fails.
+func (ur *UnRustleLogs) keepWatching(ctx context.Context, name string, watch func(context.Context) error) {
+	wait := chatReconnectMin
+	for {
+		started := time.Now()
+		err := watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > chatReconnectMax {
+			wait = chatReconnectMin
+		}
+		logrus.Warnf("%s disconnected: %v, reconnecting in %s", name, err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+		if wait *= 2; wait > chatReconnectMax {
+			wait = chatReconnectMax
+		}
+	}
+}
+
+// watchIRC joins channel anonymously and calls msg for every PRIVMSG.
+func watchIRC(ctx context.Context, rawurl, channel string, msg func(nick, text string)) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "irc" && u.Scheme != "ircs" {
+		return fmt.Errorf("%s is not an irc url", rawurl)
+	}
+	conn, err := dialChat(ctx, u, "6667", "6697")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	channel = "#" + strings.ToLower(strings.TrimPrefix(channel, "#"))
+	// justinfan is twitch's read only anonymous login
+	fmt.Fprintf(conn, "NICK justinfan%d\r\nJOIN %s\r\n", 10000+rand.Intn(89999), channel)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "PING") {
+			fmt.Fprintf(conn, "PONG%s\r\n", strings.TrimPrefix(line, "PING"))
+			continue
+		}
+		if nick, text, ok := parsePrivmsg(line, channel); ok {
+			msg(nick, text)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed")
+}
+
+// parsePrivmsg parses ":nick!user@host PRIVMSG #channel :text".
+func parsePrivmsg(line, channel string) (string, string, bool) {
+	if strings.HasPrefix(line, "@") {
+		// tags are only sent if requested, skip them anyway
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return "", "", false
+		}
+		line = line[i+1:]
+	}
+	if !strings.HasPrefix(line, ":") {
+		return "", "", false
+	}
+	parts := strings.SplitN(line[1:], " ", 4)
+	if len(parts) < 4 || parts[1] != "PRIVMSG" || !strings.EqualFold(parts[2], channel) {
+		return "", "", false
+	}
+	nick := parts[0]
+	if i := strings.IndexByte(nick, '!'); i >= 0 {
+		nick = nick[:i]
+	}
+	return nick, strings.TrimPrefix(parts[3], ":"), true
+}
+
+// watchDestinyggChat calls msg for every chat message, the chat sends
+// frames like `MSG {"nick":"name","data":"text"}`.
+func watchDestinyggChat(ctx context.Context, rawurl string, msg func(nick, text string)) error {
+	conn, err := wsDial(ctx, rawurl)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		frame, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(string(frame), " ", 2)
+		if len(parts) != 2 || parts[0] != "MSG" {
+			continue
+		}
+		var m struct {
+			Nick string `json:"nick"`
+			Data string `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(parts[1]), &m); err != nil {
+			continue
+		}
+		msg(m.Nick, m.Data)
+	}
+}
+
+// chatChallengeHandle issues a challenge for the open request of the user
+// logged in with the given cookie.
+func (ur *UnRustleLogs) chatChallengeHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		r, ok := ur.OpenDeletionRequest(user.ID)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		if _, err := ur.IssueChatChallenge(user, r, c.PostForm("chat"), c.PostForm("name")); err != nil {
+			code := "failed"
+			switch err {
+			case errChatUnknown:
+				code = "unknown"
+			case errChatName:
+				code = "name"
+			case errChatVerified:
+				code = "verified"
+			default:
+				logrus.Error(err)
+			}
+			c.Redirect(http.StatusFound, redirect+"?challenge="+code)
+			return
+		}
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
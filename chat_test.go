@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ircStandIn accepts a single connection, checks that it logs in
+// anonymously and joins channel, then hands it to serve.
+func ircStandIn(t *testing.T, channel string, serve func(conn net.Conn, r *bufio.Reader)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		nick, _ := r.ReadString('\n')
+		join, _ := r.ReadString('\n')
+		if !strings.HasPrefix(nick, "NICK justinfan") || join != "JOIN "+channel+"\r\n" {
+			t.Errorf("logged in with %q and %q", nick, join)
+			return
+		}
+		serve(conn, r)
+	}()
+	return ln
+}
+
+// untilClosed blocks until the client hangs up.
+func untilClosed(conn net.Conn, r *bufio.Reader) {
+	io.Copy(ioutil.Discard, r)
+}
+
+func TestWatchIRC(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   func(conn net.Conn, r *bufio.Reader)
+		timeout time.Duration
+		want    []string
+		err     string
+	}{
+		{
+			name: "messages",
+			serve: func(conn net.Conn, r *bufio.Reader) {
+				io.WriteString(conn, "PING :tmi.twitch.tv\r\n")
+				if pong, _ := r.ReadString('\n'); pong != "PONG :tmi.twitch.tv\r\n" {
+					t.Errorf("answered the ping with %q", pong)
+					return
+				}
+				io.WriteString(conn, ":tmi.twitch.tv 001 justinfan :Welcome, GLHF!\r\n"+
+					":bob!bob@bob.tmi.twitch.tv PRIVMSG #destiny :hello: there\r\n"+
+					"@badges=subscriber/12 :Carol!carol@carol.tmi.twitch.tv PRIVMSG #Destiny :UR-ABC234\r\n"+
+					":dave!dave@dave.tmi.twitch.tv PRIVMSG #other :elsewhere\r\n")
+			},
+			want: []string{"bob: hello: there", "Carol: UR-ABC234"},
+			err:  "connection closed",
+		},
+		{
+			name:  "closed connection",
+			serve: func(net.Conn, *bufio.Reader) {},
+			err:   "connection closed",
+		},
+		{
+			name:    "timeout",
+			serve:   untilClosed,
+			timeout: 100 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		ln := ircStandIn(t, "#destiny", tt.serve)
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), tt.timeout)
+		}
+
+		var got []string
+		result := make(chan error, 1)
+		go func() {
+			result <- watchIRC(ctx, "irc://"+ln.Addr().String(), "Destiny", func(nick, text string) {
+				got = append(got, nick+": "+text)
+			})
+		}()
+		select {
+		case err := <-result:
+			switch {
+			case err == nil:
+				t.Errorf("%s: watching stopped without an error", tt.name)
+			case tt.err != "" && err.Error() != tt.err:
+				t.Errorf("%s: error is %v, want %q", tt.name, err, tt.err)
+			case tt.timeout > 0 && ctx.Err() == nil:
+				t.Errorf("%s: stopped before the timeout: %v", tt.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: watching didn't stop", tt.name)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.want)
+		}
+		cancel()
+		ln.Close()
+	}
+
+	if err := watchIRC(context.Background(), "https://irc.chat.twitch.tv", "destiny", nil); err == nil {
+		t.Error("watched a non irc url")
+	}
+}
+
+func TestChatChallenges(t *testing.T) {
+	ur := testRustle(t, &User{}, &DeletionRequest{}, &RequestTransition{}, &EmailVerification{}, &IdentityAlias{},
+		&StaffRole{}, &AuditEntry{}, &ConfigRole{}, &Person{}, &ChatChallenge{})
+	ur.config.Chat.TwitchChannel = "Destiny"
+
+	challenge := func(service, name, chat string) (*DeletionRequest, *ChatChallenge) {
+		user := &User{ID: "user-" + name, Service: service, UserID: name, Name: name}
+		if err := ur.db.Create(user).Error; err != nil {
+			t.Fatal(err)
+		}
+		r, err := ur.CreateDeletionRequest(user.ID, Actor{Name: userActorName(user)}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ch, err := ur.IssueChatChallenge(user, r, chat, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, ch
+	}
+
+	// the destiny.gg url is only known once the stand-in runs
+	var mu sync.Mutex
+	var dggFrames [][]byte
+	dgg := wsStandIn(t, wsAccept, func(conn net.Conn, br *bufio.Reader) {
+		mu.Lock()
+		frames := dggFrames
+		mu.Unlock()
+		for _, f := range frames {
+			conn.Write(f)
+		}
+		untilClosed(conn, br)
+	})
+	defer dgg.Close()
+	ur.config.Chat.DestinyggWebsocket = wsURL(dgg)
+
+	alice, aliceCh := challenge(TWITCHSERVICE, "alice", TWITCHSERVICE)
+	bob, bobCh := challenge(DESTINYGGSERVICE, "bob", DESTINYGGSERVICE)
+	carol, carolCh := challenge(TWITCHSERVICE, "carol", TWITCHSERVICE)
+	dave, daveCh := challenge(TWITCHSERVICE, "dave", TWITCHSERVICE)
+	if err := ur.db.Model(daveCh).Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	dggFrames = [][]byte{
+		serverFrame(true, wsText, []byte(`NAMES {"connectioncount":1,"users":[]}`)),
+		serverFrame(false, wsText, []byte(`MSG {"nick":"Bob","data":"`)),
+		serverFrame(true, wsContinuation, []byte(bobCh.Code+`"}`)),
+	}
+	mu.Unlock()
+
+	// lines are handled in order, once alice is verified every line
+	// before hers has been seen
+	irc := ircStandIn(t, "#destiny", func(conn net.Conn, r *bufio.Reader) {
+		io.WriteString(conn, ":mallory!m@m.tmi.twitch.tv PRIVMSG #destiny :"+carolCh.Code+"\r\n"+
+			":carol!c@c.tmi.twitch.tv PRIVMSG #destiny :is it UR-WRONG2 ?\r\n"+
+			":dave!d@d.tmi.twitch.tv PRIVMSG #destiny :"+daveCh.Code+"\r\n"+
+			":alice!a@a.tmi.twitch.tv PRIVMSG #destiny :my code is "+aliceCh.Code+"\r\n")
+		untilClosed(conn, r)
+	})
+	defer irc.Close()
+	ur.config.Chat.TwitchIRC = "irc://" + irc.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ur.watchChats(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, aliceOK := ur.VerifiedChatChallenge(alice.ID)
+		_, bobOK := ur.VerifiedChatChallenge(bob.ID)
+		if aliceOK && bobOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("challenges of alice (%v) and bob (%v) weren't verified", aliceOK, bobOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := ur.VerifiedChatChallenge(carol.ID); ok {
+		t.Error("carol was verified by someone else's message or a wrong code")
+	}
+	if _, ok := ur.VerifiedChatChallenge(dave.ID); ok {
+		t.Error("dave was verified after the challenge expired")
+	}
+	for _, r := range []*DeletionRequest{alice, bob} {
+		if got, _ := ur.GetDeletionRequest(r.ID); got.Status == StatusSubmitted {
+			t.Errorf("request of %s is still %s", r.UserID, got.Status)
+		}
+	}
+	if _, _, err := ur.VerifyAudit(); err != nil {
+		t.Error(err)
+	}
+}
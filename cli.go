@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tensei/unrustlelogs/redact"
+)
+
+// commands that can be run instead of the web server, e.g.
+//
+//	unrustlelogs redact -request <id> -dry-run
+var commands = map[string]func(ur *UnRustleLogs, args []string) error{
+	"redact":       (*UnRustleLogs).redactCommand,
+	"role":         (*UnRustleLogs).roleCommand,
+	"audit-export": (*UnRustleLogs).auditExportCommand,
+	"verify-audit": (*UnRustleLogs).verifyAuditCommand,
+	"keys":         (*UnRustleLogs).keysCommand,
+}
+
+// runCommand runs the command named by args[0] and returns the exit code.
+func (ur *UnRustleLogs) runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	if err := cmd(ur, args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (ur *UnRustleLogs) redactCommand(args []string) error {
+	fs := flag.NewFlagSet("redact", flag.ContinueOnError)
+	requestID := fs.String("request", "", "id of the approved deletion request")
+	logs := fs.String("logs", ur.config.Logs.Path, "root of the log archive")
+	mask := fs.Bool("mask", false, "mask lines instead of removing them")
+	dryRun := fs.Bool("dry-run", false, "only report what would change")
+	force := fs.Bool("force", false, "redact even if name ownership has conflicts")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *requestID == "" || *logs == "" {
+		fs.Usage()
+		return fmt.Errorf("-request and -logs are required")
+	}
+
+	r, ok := ur.GetDeletionRequest(*requestID)
+	if !ok {
+		return fmt.Errorf("request %q not found", *requestID)
+	}
+	job := redactJob{
+		Request: r,
+		Actor:   cliActor,
+		Logs:    *logs,
+		DryRun:  *dryRun,
+		Force:   *force,
+	}
+	if *mask {
+		job.Mode = redact.Mask
+	}
+	res, err := ur.runRedaction(job)
+	if res != nil {
+		for _, c := range res.Conflicts {
+			fmt.Printf("conflict %s: %s\n", c.Name, c.Reason)
+		}
+		if res.Report != nil {
+			printReport(res.Report, res.Windows)
+		}
+	}
+	return err
+}
+
+func printReport(report *redact.Report, windows []OwnershipWindow) {
+	action := report.Mode.String()
+	if report.DryRun {
+		action = "would " + action
+	}
+	for _, w := range windows {
+		fmt.Printf("%s: owned %s\n", w.Name, formatPeriod(w.From, w.To))
+	}
+	for _, f := range report.Files {
+		fmt.Printf("%s: %s %d of %d lines %v\n", f.Path, action, f.Matched, f.Lines, f.MatchedLines)
+		if f.Flagged > 0 {
+			fmt.Printf("%s: %d lines need review %v\n", f.Path, f.Flagged, f.FlaggedLines)
+		}
+	}
+	logrus.Infof("%s %d of %d lines in %d files, %d lines need review", action, report.Matched, report.Lines, len(report.Files), report.Flagged)
+}
@@ -20,9 +20,54 @@ type Config struct {
 		RedirectURL  string `toml:"redirect_url"`
 		Cookie       string
 	}
+	Discord struct {
+		ClientID     string `toml:"client_id"`
+		ClientSecret string `toml:"client_secret"`
+		RedirectURL  string `toml:"redirect_url"`
+		Cookie       string
+	}
+	// OIDC are generic OpenID Connect providers
+	OIDC []OIDCConfig `toml:"oidc"`
+	Mail struct {
+		// Backend is either "smtp" or "maildir"
+		Backend string
+		From    string
+		BaseURL string `toml:"base_url"`
+		Maildir string
+		SMTP    struct {
+			Host     string
+			Port     int
+			Username string
+			Password string
+		}
+	}
+	Logs struct {
+		// Path is the root of the OverRustleLogs archive
+		Path string
+	}
+	Policy    PolicyConfig
+	Fraud     FraudConfig
+	Chat      ChatConfig
+	JWT       JWTConfig
+	RateLimit RateLimitConfig `toml:"rate_limit"`
+	// Staff assigns roles to provider identities
+	Staff []struct {
+		Service string
+		UserID  string `toml:"user_id"`
+		Role    string
+	}
 	Server struct {
-		Address   string
+		Address string
+		// JWTSecret only verifies tokens from before the keyring, it signs
+		// while the keyring is empty
 		JWTSecret string `toml:"jwt_secret"`
+		// StateStore keeps logins in progress, "memory" or "sqlite" to
+		// share them between instances and restarts
+		StateStore string `toml:"state_store"`
+		MaxStates  int    `toml:"max_states"`
+		// TrustedProxies may set X-Forwarded-For and X-Real-IP, ips or
+		// cidrs, defaults to loopback where the bundled nginx connects from
+		TrustedProxies []string `toml:"trusted_proxies"`
 	}
 }
 
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	csrfCookie = "csrf"
+	csrfField  = "csrf"
+	csrfHeader = "X-CSRF-Token"
+	// csrfTokenLength is the length of 32 random bytes in base64
+	csrfTokenLength = 43
+)
+
+// secureRequest reports whether the visitor talks to us over https, nginx
+// terminates tls and tells us with X-Forwarded-Proto.
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// setCookie writes a cookie scripts can't read, a negative maxAge deletes
+// it.
+func setCookie(c *gin.Context, name, value string, maxAge int, sameSite http.SameSite) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   maxAge,
+		Path:     "/",
+		Domain:   c.Request.Host,
+		Secure:   secureRequest(c),
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrfToken returns the token forms on this page have to send back.
+func csrfToken(c *gin.Context) string {
+	return c.GetString(csrfCookie)
+}
+
+// sameOrigin rejects requests a browser says came from another site, older
+// browsers don't send Origin at all.
+func sameOrigin(c *gin.Context) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == c.Request.Host
+}
+
+// csrfMiddleware hands every visitor a token in a cookie and requires it
+// back with every request that changes something. Other sites can make the
+// browser send the cookie but can't read it to fill in the form.
+func (ur *UnRustleLogs) csrfMiddleware(c *gin.Context) {
+	token, err := c.Cookie(csrfCookie)
+	if err != nil || len(token) != csrfTokenLength {
+		token = newCSRFToken()
+		setCookie(c, csrfCookie, token, int(sessionMaxAge.Seconds()), http.SameSiteLaxMode)
+	}
+	c.Set(csrfCookie, token)
+
+	switch c.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		c.Next()
+		return
+	}
+	sent := c.PostForm(csrfField)
+	if sent == "" {
+		sent = c.GetHeader(csrfHeader)
+	}
+	if !sameOrigin(c) || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		logrus.Warnf("csrf check failed for %s %s", c.Request.Method, c.Request.URL.Path)
+		ur.errorPage(c, http.StatusForbidden, ErrorPayload{
+			Title:   "Request blocked",
+			Message: "This form was sent from another site or is out of date, please reload the page and try again.",
+			Back:    "/",
+		})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
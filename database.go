@@ -2,6 +2,7 @@ package main
 
 import (
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,6 +23,19 @@ type User struct {
 	Nick        string
 	UserID      string
 	Email       string
+
+	// PersonID links the identities of one human
+	PersonID string `gorm:"index"`
+
+	// what the provider reported, used by the policy
+	EmailVerified bool
+	AccountStatus string
+	// Roles and Features are comma separated
+	Roles    string
+	Features string
+
+	// AccountCreatedAt is when the account was created at the provider
+	AccountCreatedAt *time.Time
 }
 
 // NewDatabase ...
@@ -36,49 +50,81 @@ func (ur *UnRustleLogs) NewDatabase() {
 		logrus.Fatal(err)
 	}
 
-	ur.db.AutoMigrate(&User{})
-}
-
-// AddTwitchUser ...
-func (ur *UnRustleLogs) AddTwitchUser(user *TwitchUser) string {
-	if id, ok := ur.UserInDatabase(user.Name, TWITCHSERVICE); ok {
-		return id
+	ur.db.AutoMigrate(&User{}, &DeletionRequest{}, &RequestTransition{}, &EmailVerification{}, &IdentityAlias{}, &StaffRole{}, &AuditEntry{}, &ConfigRole{}, &Person{}, &ChatChallenge{}, &Session{}, &OAuthState{}, &RateBucket{})
+	if err := ur.backfillAliases(); err != nil {
+		logrus.Error(err)
+	}
+	if err := ur.backfillPersons(); err != nil {
+		logrus.Error(err)
 	}
-	id, _ := uuid.NewRandom()
-	ur.db.Create(&User{
-		ID:          id.String(),
-		Name:        user.Name,
-		DisplayName: user.DisplayName,
-		Email:       user.Email,
-		UserID:      user.ID,
-		Service:     TWITCHSERVICE,
-	})
-	return id.String()
 }
 
-// AddDggUser ...
-func (ur *UnRustleLogs) AddDggUser(user *DestinyggUser) string {
-	if id, ok := ur.UserInDatabase(user.Username, DESTINYGGSERVICE); ok {
-		return id
-	}
-	id, _ := uuid.NewRandom()
-	ur.db.Create(&User{
-		ID:          id.String(),
-		Name:        user.Username,
-		DisplayName: user.Nick,
-		UserID:      user.UserID,
-		Service:     DESTINYGGSERVICE,
+// AddUser stores the identity a user logged in with and returns the id
+// of its User.
+func (ur *UnRustleLogs) AddUser(identity *Identity) string {
+	return ur.upsertUser(&User{
+		AccountCreatedAt: identity.CreatedAt,
+		Name:             identity.Name,
+		DisplayName:      identity.DisplayName,
+		Nick:             identity.Nick,
+		Email:            identity.Email,
+		UserID:           identity.UserID,
+		Service:          identity.Service,
+		EmailVerified:    identity.EmailVerified,
+		AccountStatus:    identity.Status,
+		Roles:            strings.Join(identity.Roles, ","),
+		Features:         strings.Join(identity.Features, ","),
 	})
-	return id.String()
 }
 
-// DeleteUser ...
-func (ur *UnRustleLogs) DeleteUser(name, service string) {
+// upsertUser looks the user up by its provider id and refreshes the stored
+// names, every name and email seen is kept as an alias.
+func (ur *UnRustleLogs) upsertUser(seen *User) string {
 	var u User
-	ur.db.Where("name = ? and service = ?", name, service).First(&u)
-	if name == u.Name && service == u.Service {
-		ur.db.Delete(&u)
+	err := ur.transaction(func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		err := tx.Where("service = ? and user_id = ?", seen.Service, seen.UserID).Order("created_at asc").First(&u).Error
+		if gorm.IsRecordNotFoundError(err) {
+			id, err := uuid.NewRandom()
+			if err != nil {
+				return err
+			}
+			u = *seen
+			u.ID = id.String()
+			if u.PersonID, err = createPerson(tx); err != nil {
+				return err
+			}
+			if err := tx.Create(&u).Error; err != nil {
+				return err
+			}
+			return recordAliases(tx, &u, now)
+		}
+		if err != nil {
+			return err
+		}
+		updates := map[string]interface{}{
+			"name":           seen.Name,
+			"display_name":   seen.DisplayName,
+			"nick":           seen.Nick,
+			"email":          seen.Email,
+			"email_verified": seen.EmailVerified,
+			"account_status": seen.AccountStatus,
+			"roles":          seen.Roles,
+			"features":       seen.Features,
+		}
+		if seen.AccountCreatedAt != nil {
+			updates["account_created_at"] = seen.AccountCreatedAt
+		}
+		err = tx.Model(&u).Updates(updates).Error
+		if err != nil {
+			return err
+		}
+		return recordAliases(tx, &u, now)
+	})
+	if err != nil {
+		logrus.Error(err)
 	}
+	return u.ID
 }
 
 // UserInDatabase ...
@@ -94,3 +140,17 @@ func (ur *UnRustleLogs) GetUser(id string) (*User, bool) {
 	ur.db.Where("id = ?", id).First(&u)
 	return &u, u.ID == id
 }
+
+// transaction runs fn inside a database transaction, fn returning an error
+// rolls everything back.
+func (ur *UnRustleLogs) transaction(fn func(tx *gorm.DB) error) error {
+	tx := ur.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.RollbackUnlessCommitted()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit().Error
+}
@@ -1,117 +1,118 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
+	"net/url"
 
-	"github.com/dgrijalva/jwt-go"
-	"github.com/sirupsen/logrus"
-
-	"github.com/dchest/uniuri"
-	"github.com/gin-gonic/gin"
 	"github.com/tensei/dggoauth"
 )
 
-func (ur *UnRustleLogs) setupDestinyggClient() (err error) {
-	ur.dggOauthClient, err = dggoauth.NewClient(&dggoauth.Options{
-		ClientID:     ur.config.Destinygg.ClientID,
-		ClientSecret: ur.config.Destinygg.ClientSecret,
-		RedirectURI:  ur.config.Destinygg.RedirectURL,
-	})
-	return err
+// DestinyggUser ...
+type DestinyggUser struct {
+	CreatedDate string   `json:"createdDate"`
+	Features    []string `json:"features"`
+	Nick        string   `json:"nick"`
+	Roles       []string `json:"roles"`
+	Status      string   `json:"status"`
+	// Subscription interface{} `json:"subscription"`
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
 }
 
-// DestinyggLoginHandle ...
-func (ur *UnRustleLogs) DestinyggLoginHandle(c *gin.Context) {
-	state := uniuri.NewLen(60)
-	url, verifier := ur.dggOauthClient.GetAuthorizationURL(state)
-	ur.addDggState(state, verifier)
-
-	c.Header("Location", url)
-	c.Redirect(http.StatusFound, url)
+// destinyggProvider can't revoke tokens, destiny.gg has no endpoint for it.
+type destinyggProvider struct {
+	cookie string
+	oauth  *dggoauth.Client
+	client *http.Client
 }
 
-// DestinyggCallbackHandle ...
-func (ur *UnRustleLogs) DestinyggCallbackHandle(c *gin.Context) {
-	state := c.Query("state")
-	verifier, ok := ur.hasDggState(state)
-	if !ok {
-		c.Redirect(http.StatusFound, "/")
-		return
-	}
-	go ur.deleteDggState(state)
-	code := c.Query("code")
-	access, err := ur.dggOauthClient.GetAccessToken(code, verifier)
-	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "something went wrong try again",
-		})
-		return
-	}
-	user, err := ur.getDggUser(access.AccessToken)
+func newDestinyggProvider(config *Config) (*destinyggProvider, error) {
+	client := newProviderClient(DESTINYGGSERVICE)
+	oauth, err := dggoauth.NewClient(&dggoauth.Options{
+		ClientID:     config.Destinygg.ClientID,
+		ClientSecret: config.Destinygg.ClientSecret,
+		RedirectURI:  config.Destinygg.RedirectURL,
+		HTTPClient:   withoutRetries(client),
+	})
 	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"message": "failed getting userinfo",
-		})
-		return
+		return nil, err
 	}
+	return &destinyggProvider{
+		cookie: config.Destinygg.Cookie,
+		oauth:  oauth,
+		client: client,
+	}, nil
+}
 
-	id := ur.AddDggUser(user)
-	// Set custom claims
-	claims := &jwtClaims{
-		id,
-		jwt.StandardClaims{
-			// 1 month expire
-			ExpiresAt: time.Now().Add((time.Hour * 24) * 31).Unix(),
-		},
+func (p *destinyggProvider) Info() ProviderInfo {
+	return ProviderInfo{
+		Service: DESTINYGGSERVICE,
+		Path:    "/dgg",
+		Title:   "Destiny.gg",
+		Cookie:  p.cookie,
 	}
+}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+func (p *destinyggProvider) AuthorizationURL(state string, s *oauthState) (string, error) {
+	url, verifier := p.oauth.GetAuthorizationURL(state)
+	s.Verifier = verifier
+	return url, nil
+}
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(ur.config.Server.JWTSecret))
+func (p *destinyggProvider) Exchange(ctx context.Context, code string, s *oauthState) (*Token, error) {
+	access, err := p.oauth.GetAccessToken(code, s.Verifier)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed signing jwt"})
-		return
+		return nil, providerError(DESTINYGGSERVICE, "token exchange", err)
 	}
-
-	c.SetCookie(ur.config.Destinygg.Cookie, t, 604800, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
-	c.Redirect(http.StatusFound, "/dgg")
+	return &Token{
+		AccessToken:  access.AccessToken,
+		RefreshToken: access.RefreshToken,
+		ExpiresIn:    access.ExpiresIn,
+	}, nil
 }
 
-// DestinyggUser ...
-type DestinyggUser struct {
-	CreatedDate string   `json:"createdDate"`
-	Features    []string `json:"features"`
-	Nick        string   `json:"nick"`
-	Roles       []string `json:"roles"`
-	Status      string   `json:"status"`
-	// Subscription interface{} `json:"subscription"`
-	UserID   string `json:"userId"`
-	Username string `json:"username"`
+func (p *destinyggProvider) Identity(ctx context.Context, token *Token, s *oauthState) (*Identity, error) {
+	user, err := p.getDggUser(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		Service:     DESTINYGGSERVICE,
+		UserID:      user.UserID,
+		Name:        user.Username,
+		DisplayName: user.Nick,
+		CreatedAt:   parseDggTime(user.CreatedDate),
+		Status:      user.Status,
+		Roles:       user.Roles,
+		Features:    user.Features,
+	}, nil
 }
 
-func (ur *UnRustleLogs) getDggUser(accessToken string) (*DestinyggUser, error) {
-	dggURL := fmt.Sprintf("https://destiny.gg/api/userinfo?token=%s", accessToken)
-	response, err := ur.dggHTTPClient.Get(dggURL)
+func (p *destinyggProvider) getDggUser(ctx context.Context, accessToken string) (*DestinyggUser, error) {
+	dggURL := fmt.Sprintf("https://destiny.gg/api/userinfo?token=%s", url.QueryEscape(accessToken))
+	req, err := http.NewRequest("GET", dggURL, nil)
 	if err != nil {
 		return nil, err
 	}
+	response, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, providerError(DESTINYGGSERVICE, "user lookup", err)
+	}
 	defer response.Body.Close()
+	if err := checkResponse(DESTINYGGSERVICE, "user lookup", response); err != nil {
+		return nil, err
+	}
 
 	var userinfo DestinyggUser
-	err = json.NewDecoder(response.Body).Decode(&userinfo)
-
-	return &userinfo, err
-}
-
-// DestinyggLogoutHandle ...
-func (ur *UnRustleLogs) DestinyggLogoutHandle(c *gin.Context) {
-	ur.deleteCookie(c, ur.config.Destinygg.Cookie)
-	c.Redirect(http.StatusFound, "/")
+	if err := json.NewDecoder(response.Body).Decode(&userinfo); err != nil {
+		return nil, providerError(DESTINYGGSERVICE, "user lookup", err)
+	}
+	if userinfo.UserID == "" {
+		return nil, providerError(DESTINYGGSERVICE, "user lookup", errors.New("empty user"))
+	}
+	return &userinfo, nil
 }
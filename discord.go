@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	discordAuthURL  = "https://discord.com/oauth2/authorize"
+	discordTokenURL = "https://discord.com/api/oauth2/token"
+	discordUserURL  = "https://discord.com/api/users/@me"
+	// revoking either token ends the whole grant
+	discordRevokeURL = "https://discord.com/api/oauth2/token/revoke"
+	// discordEpoch is the start of discord snowflake ids in milliseconds
+	discordEpoch = 1420070400000
+)
+
+var discordScopes = []string{"identify", "email"}
+
+// DiscordUser ...
+type DiscordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Email      string `json:"email"`
+	Verified   bool   `json:"verified"`
+}
+
+type discordProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	cookie       string
+	client       *http.Client
+}
+
+func newDiscordProvider(config *Config) (*discordProvider, error) {
+	return &discordProvider{
+		clientID:     config.Discord.ClientID,
+		clientSecret: config.Discord.ClientSecret,
+		redirectURL:  config.Discord.RedirectURL,
+		cookie:       config.Discord.Cookie,
+		client:       newProviderClient(DISCORDSERVICE),
+	}, nil
+}
+
+func (p *discordProvider) Info() ProviderInfo {
+	return ProviderInfo{
+		Service: DISCORDSERVICE,
+		Path:    "/discord",
+		Title:   "Discord",
+		Icon:    "fab fa-discord",
+		Cookie:  p.cookie,
+		Scopes:  discordScopes,
+	}
+}
+
+func (p *discordProvider) AuthorizationURL(state string, s *oauthState) (string, error) {
+	v := url.Values{}
+	v.Set("client_id", p.clientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("response_type", "code")
+	v.Set("scope", strings.Join(discordScopes, " "))
+	v.Set("state", state)
+	v.Set("prompt", "consent")
+	return discordAuthURL + "?" + v.Encode(), nil
+}
+
+func (p *discordProvider) Exchange(ctx context.Context, code string, s *oauthState) (*Token, error) {
+	form := url.Values{}
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	req, err := http.NewRequest("POST", discordTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, providerError(DISCORDSERVICE, "token exchange", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(DISCORDSERVICE, "token exchange", resp); err != nil {
+		return nil, err
+	}
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		Scope        string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, providerError(DISCORDSERVICE, "token exchange", err)
+	}
+	return &Token{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		ExpiresIn:    t.ExpiresIn,
+		Scopes:       strings.Fields(t.Scope),
+	}, nil
+}
+
+func (p *discordProvider) Revoke(ctx context.Context, token *Token) error {
+	form := url.Values{}
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+	form.Set("token", token.AccessToken)
+	form.Set("token_type_hint", "access_token")
+	return postForm(ctx, p.client, DISCORDSERVICE, "token revocation", discordRevokeURL, form)
+}
+
+func (p *discordProvider) Identity(ctx context.Context, token *Token, s *oauthState) (*Identity, error) {
+	user, err := p.getUser(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	identity := &Identity{
+		Service:     DISCORDSERVICE,
+		UserID:      user.ID,
+		Name:        user.Username,
+		DisplayName: user.GlobalName,
+		CreatedAt:   discordCreatedAt(user.ID),
+	}
+	if identity.DisplayName == "" {
+		identity.DisplayName = user.Username
+	}
+	if user.Verified {
+		identity.Email = user.Email
+		identity.EmailVerified = identity.Email != ""
+	}
+	return identity, nil
+}
+
+func (p *discordProvider) getUser(ctx context.Context, accessToken string) (*DiscordUser, error) {
+	req, err := http.NewRequest("GET", discordUserURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, providerError(DISCORDSERVICE, "user lookup", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(DISCORDSERVICE, "user lookup", resp); err != nil {
+		return nil, err
+	}
+	var user DiscordUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return nil, providerError(DISCORDSERVICE, "user lookup", err)
+	}
+	return &user, nil
+}
+
+// discordCreatedAt reads the creation time out of a snowflake id.
+func discordCreatedAt(id string) *time.Time {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil || n == 0 {
+		return nil
+	}
+	t := time.Unix(0, int64(n>>22+discordEpoch)*int64(time.Millisecond)).UTC()
+	return &t
+}
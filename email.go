@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// how long a verification link stays valid
+const emailVerificationTTL = time.Hour * 24
+
+const emailVerificationAudience = "email-verification"
+
+// EmailVerification is a one-time proof that the requester controls the
+// email address of their account.
+type EmailVerification struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	RequestID  string `gorm:"index"`
+	Email      string
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+}
+
+type emailClaims struct {
+	Verification string `json:"vid"`
+	jwt.StandardClaims
+}
+
+var (
+	errNoEmail             = errors.New("account has no email address")
+	errVerificationInvalid = errors.New("verification link is invalid or expired")
+)
+
+// SendEmailVerification mails a signed one-time link to the email address
+// stored for the user of the request.
+func (ur *UnRustleLogs) SendEmailVerification(user *User, r *DeletionRequest) error {
+	if strings.TrimSpace(user.Email) == "" {
+		return errNoEmail
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	v := &EmailVerification{
+		ID:        id.String(),
+		RequestID: r.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+	}
+	if err := ur.db.Create(v).Error; err != nil {
+		return err
+	}
+
+	token, err := ur.signJWT(&emailClaims{
+		v.ID,
+		ur.standardClaims(emailVerificationAudience, v.ExpiresAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/email/verify?token=%s", strings.TrimRight(ur.config.Mail.BaseURL, "/"), token)
+	body := fmt.Sprintf("Hi %s,\r\n\r\n"+
+		"someone asked UnRustleLogs to delete the logs of your %s account.\r\n"+
+		"If that was you, open the link below to confirm that you own this email address:\r\n\r\n"+
+		"%s\r\n\r\n"+
+		"The link is valid for 24 hours and can only be used once.\r\n"+
+		"If you didn't request this you can ignore this mail.\r\n",
+		user.DisplayName, user.Service, link)
+	return ur.mailer.Send(user.Email, "Confirm your UnRustleLogs request", body)
+}
+
+// ConfirmEmailVerification consumes the verification behind token and marks
+// the email of its request as verified.
+func (ur *UnRustleLogs) ConfirmEmailVerification(actor Actor, token string) (*DeletionRequest, error) {
+	claims := &emailClaims{}
+	if err := ur.parseJWT(token, claims, emailVerificationAudience); err != nil {
+		return nil, errVerificationInvalid
+	}
+
+	var r DeletionRequest
+	err := ur.transaction(func(tx *gorm.DB) error {
+		var v EmailVerification
+		if err := tx.Where("id = ?", claims.Verification).First(&v).Error; err != nil {
+			return errVerificationInvalid
+		}
+		now := time.Now()
+		if v.ConsumedAt != nil || now.After(v.ExpiresAt) {
+			return errVerificationInvalid
+		}
+		res := tx.Model(&v).Where("consumed_at is null").Update("consumed_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errVerificationInvalid
+		}
+		if err := tx.Where("id = ?", v.RequestID).First(&r).Error; err != nil {
+			return errVerificationInvalid
+		}
+		// the account email might have changed since the mail was sent
+		var count int
+		err := tx.Model(&User{}).
+			Where("email = ? and person_id = (select person_id from users where id = ?)", v.Email, r.UserID).
+			Count(&count).Error
+		if err != nil || count == 0 {
+			return errVerificationInvalid
+		}
+		return tx.Model(&r).Updates(map[string]interface{}{
+			"email":             v.Email,
+			"email_verified_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Status == StatusSubmitted {
+		if _, err := ur.TransitionRequest(r.ID, StatusIdentityVerified, actor, "email verified"); err != nil {
+			logrus.Error(err)
+		}
+	}
+	return &r, nil
+}
+
+// sendEmailVerificationHandle sends a verification mail for the open request
+// of the user logged in with the given cookie.
+func (ur *UnRustleLogs) sendEmailVerificationHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		r, ok := ur.OpenDeletionRequest(user.ID)
+		if !ok || r.EmailVerifiedAt != nil {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		if err := ur.SendEmailVerification(user, r); err != nil {
+			logrus.Error(err)
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		c.Redirect(http.StatusFound, redirect+"?email=sent")
+	}
+}
+
+// EmailPayload ...
+type EmailPayload struct {
+	Token    string
+	Verified bool
+	Error    string
+	CSRF     string
+}
+
+// emailVerifyHandler shows the confirm button, the token is only consumed on
+// POST so link scanners in mail clients don't use it up.
+func (ur *UnRustleLogs) emailVerifyHandler(c *gin.Context) {
+	c.HTML(http.StatusOK, "email.tmpl", EmailPayload{Token: c.Query("token"), CSRF: csrfToken(c)})
+}
+
+func (ur *UnRustleLogs) emailConfirmHandler(c *gin.Context) {
+	if _, err := ur.ConfirmEmailVerification(ur.actor(c, "email"), c.PostForm("token")); err != nil {
+		if err != errVerificationInvalid {
+			logrus.Error(err)
+		}
+		c.HTML(http.StatusBadRequest, "email.tmpl", EmailPayload{Error: errVerificationInvalid.Error()})
+		return
+	}
+	c.HTML(http.StatusOK, "email.tmpl", EmailPayload{Verified: true})
+}
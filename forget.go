@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// errRequestOpen is returned when a user wants to be forgotten while their
+// request is still being worked on.
+var errRequestOpen = errors.New("the request has to be completed or withdrawn first")
+
+// ForgetUser erases the user, every identity linked to them and everything
+// that identifies them. Requests are kept without their email so staff can
+// still see what was done, the audit entry only records the random user id.
+func (ur *UnRustleLogs) ForgetUser(actor Actor, id string) error {
+	return ur.auditTransaction(func(tx *gorm.DB) error {
+		var u User
+		if err := tx.Where("id = ?", id).First(&u).Error; err != nil {
+			return err
+		}
+		// every linked identity and older rows of the same identity go too
+		var users []User
+		q := tx.Where("service = ? and user_id = ?", u.Service, u.UserID)
+		if u.PersonID != "" {
+			q = tx.Where("person_id = ? or (service = ? and user_id = ?)", u.PersonID, u.Service, u.UserID)
+		}
+		if err := q.Find(&users).Error; err != nil {
+			return err
+		}
+		userIDs := make([]string, len(users))
+		for i, user := range users {
+			userIDs[i] = user.ID
+		}
+
+		var requests []DeletionRequest
+		if err := tx.Where("user_id in (?)", userIDs).Find(&requests).Error; err != nil {
+			return err
+		}
+		requestIDs := []string{}
+		for _, r := range requests {
+			if r.Status.Open() {
+				return errRequestOpen
+			}
+			requestIDs = append(requestIDs, r.ID)
+		}
+
+		var aliases int64
+		for _, user := range users {
+			removed := tx.Where("service = ? and user_id = ?", user.Service, user.UserID).Delete(&IdentityAlias{})
+			if removed.Error != nil {
+				return removed.Error
+			}
+			aliases += removed.RowsAffected
+		}
+
+		verifications := tx.Where("request_id in (?)", requestIDs).Delete(&EmailVerification{})
+		if verifications.Error != nil {
+			return verifications.Error
+		}
+		if err := tx.Where("request_id in (?)", requestIDs).Delete(&ChatChallenge{}).Error; err != nil {
+			return err
+		}
+		// sessions know where and with what browser they logged in
+		if err := tx.Where("user_id in (?)", userIDs).Delete(&Session{}).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&DeletionRequest{}).Where("id in (?)", requestIDs).Updates(map[string]interface{}{
+			"email":     "",
+			"client_ip": "",
+			"session":   "",
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("id in (?)", userIDs).Delete(&User{}).Error; err != nil {
+			return err
+		}
+		if u.PersonID != "" {
+			if err := tx.Where("id = ?", u.PersonID).Delete(&Person{}).Error; err != nil {
+				return err
+			}
+		}
+
+		details := fmt.Sprintf("%d users, %d aliases and %d email verifications erased, %d requests kept",
+			len(userIDs), aliases, verifications.RowsAffected, len(requestIDs))
+		return ur.appendAudit(tx, actor, AuditUserForget, "user:"+u.ID, details)
+	})
+}
+
+// forgetUserHandle erases the user logged in with the given cookie and logs
+// them out.
+func (ur *UnRustleLogs) forgetUserHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		// the ip is personal data as well
+		actor := Actor{Name: userActorName(user), RequestID: c.GetString("request_id")}
+		if err := ur.ForgetUser(actor, user.ID); err != nil {
+			if err != errRequestOpen {
+				logrus.Error(err)
+			}
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		// linked identities are gone as well
+		for _, cookie := range ur.providerCookies() {
+			ur.deleteCookie(c, cookie)
+		}
+		c.Redirect(http.StatusFound, redirect+"?forgotten=1")
+	}
+}
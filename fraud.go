@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// fraud flags
+const (
+	FlagNewAccount    = "new_account"
+	FlagSharedEmail   = "shared_email"
+	FlagIPBurst       = "ip_burst"
+	FlagSessionBurst  = "session_burst"
+	FlagRecentRename  = "recent_rename"
+	FlagWithdrawCycle = "withdraw_cycle"
+)
+
+// FraudConfig tunes when requests are flagged, zero values use the defaults.
+type FraudConfig struct {
+	NewAccountDays        int `toml:"new_account_days"`
+	RenameDays            int `toml:"rename_days"`
+	MaxEmailPersons       int `toml:"max_email_persons"`
+	MaxRequestsPerIP      int `toml:"max_requests_per_ip"`
+	MaxRequestsPerSession int `toml:"max_requests_per_session"`
+	RequestWindowHours    int `toml:"request_window_hours"`
+	MaxWithdrawals        int `toml:"max_withdrawals"`
+	// KnownChatters are names worth impersonating
+	KnownChatters []string `toml:"known_chatters"`
+}
+
+func (c FraudConfig) withDefaults() FraudConfig {
+	def := func(v *int, d int) {
+		if *v <= 0 {
+			*v = d
+		}
+	}
+	def(&c.NewAccountDays, 30)
+	def(&c.RenameDays, 30)
+	def(&c.MaxEmailPersons, 1)
+	def(&c.MaxRequestsPerIP, 3)
+	def(&c.MaxRequestsPerSession, 1)
+	def(&c.RequestWindowHours, 24)
+	def(&c.MaxWithdrawals, 2)
+	return c
+}
+
+// FraudFlag is a reason to look at a request more closely.
+type FraudFlag struct {
+	Name   string
+	Reason string
+}
+
+func daysAgo(t time.Time) int {
+	return int(time.Since(t).Hours() / 24)
+}
+
+// FraudFlags checks a request for signs of impersonation or abuse. A
+// failed check is an error rather than no flag, so a broken database can't
+// make a request look clean.
+func (ur *UnRustleLogs) FraudFlags(r *DeletionRequest) ([]FraudFlag, error) {
+	cfg := ur.config.Fraud.withDefaults()
+	var flags []FraudFlag
+	flag := func(name, format string, args ...interface{}) {
+		flags = append(flags, FraudFlag{name, fmt.Sprintf(format, args...)})
+	}
+	var failed []string
+	check := func(name string, err error) bool {
+		if err != nil {
+			failed = append(failed, name+": "+err.Error())
+		}
+		return err == nil
+	}
+
+	user, ok := ur.GetUser(r.UserID)
+	if !ok {
+		return nil, fmt.Errorf("fraud checks failed: user %s not found", r.UserID)
+	}
+	linked := ur.LinkedUsers(user)
+	ids := make([]string, len(linked))
+	for i, u := range linked {
+		ids[i] = u.ID
+	}
+
+	// a throwaway linked to an old account is fine, so only the oldest counts
+	var oldest *time.Time
+	for _, u := range linked {
+		if u.AccountCreatedAt != nil && (oldest == nil || u.AccountCreatedAt.Before(*oldest)) {
+			oldest = u.AccountCreatedAt
+		}
+	}
+	if oldest != nil && time.Since(*oldest) < time.Duration(cfg.NewAccountDays)*time.Hour*24 {
+		flag(FlagNewAccount, "oldest account was created %d days ago", daysAgo(*oldest))
+	}
+
+	emails := []string{}
+	for _, e := range append([]string{r.Email}, userEmails(linked)...) {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			emails = append(emails, e)
+		}
+	}
+	if len(emails) > 0 {
+		var count int
+		err := ur.db.Table("users").
+			Joins("left join identity_aliases on identity_aliases.service = users.service and identity_aliases.user_id = users.user_id and identity_aliases.kind = ?", AliasEmail).
+			Where("(lower(users.email) in (?) or lower(identity_aliases.value) in (?)) and users.person_id <> ?", emails, emails, user.PersonID).
+			Select("count(distinct users.person_id)").
+			Row().Scan(&count)
+		if check(FlagSharedEmail, err) && count >= cfg.MaxEmailPersons {
+			flag(FlagSharedEmail, "%d other persons use the same email", count)
+		}
+	}
+
+	window := time.Duration(cfg.RequestWindowHours) * time.Hour
+	from, to := r.CreatedAt.Add(-window), r.CreatedAt.Add(window)
+	if r.ClientIP != "" {
+		var count int
+		err := ur.db.Model(&DeletionRequest{}).
+			Where("client_ip = ? and id <> ? and created_at between ? and ?", r.ClientIP, r.ID, from, to).
+			Count(&count).Error
+		if check(FlagIPBurst, err) && count >= cfg.MaxRequestsPerIP {
+			flag(FlagIPBurst, "%d other requests from the same ip within %d hours", count, cfg.RequestWindowHours)
+		}
+	}
+	if r.Session != "" {
+		var count int
+		err := ur.db.Model(&DeletionRequest{}).
+			Where("session = ? and id <> ? and created_at between ? and ?", r.Session, r.ID, from, to).
+			Count(&count).Error
+		if check(FlagSessionBurst, err) && count >= cfg.MaxRequestsPerSession {
+			flag(FlagSessionBurst, "%d other requests from the same login session within %d hours", count, cfg.RequestWindowHours)
+		}
+	}
+
+	for _, u := range linked {
+		renames, err := ur.recentRenames(u, time.Duration(cfg.RenameDays)*time.Hour*24)
+		if !check(FlagRecentRename, err) {
+			continue
+		}
+		for _, name := range renames {
+			if containsFold(cfg.KnownChatters, name.Value) {
+				flag(FlagRecentRename, "%s renamed to the known chatter %s %d days ago", u.Service, name.Value, daysAgo(name.FirstSeen))
+				continue
+			}
+			used, err := ur.nameUsedElsewhere(user.PersonID, u.Service, name.Value)
+			if check(FlagRecentRename, err) && used {
+				flag(FlagRecentRename, "%s renamed to %s %d days ago, another identity used that name", u.Service, name.Value, daysAgo(name.FirstSeen))
+			}
+		}
+	}
+
+	var withdrawn int
+	err := ur.db.Model(&DeletionRequest{}).Where("user_id in (?) and status = ?", ids, StatusWithdrawn).Count(&withdrawn).Error
+	if check(FlagWithdrawCycle, err) && withdrawn >= cfg.MaxWithdrawals {
+		flag(FlagWithdrawCycle, "%d earlier requests were withdrawn", withdrawn)
+	}
+	if len(failed) > 0 {
+		return flags, fmt.Errorf("fraud checks failed: %s", strings.Join(failed, "; "))
+	}
+	return flags, nil
+}
+
+func userEmails(users []*User) []string {
+	emails := make([]string, len(users))
+	for i, u := range users {
+		emails[i] = u.Email
+	}
+	return emails
+}
+
+// recentRenames returns the names the user took within the last d, the
+// name the account was first seen with and names proven in another
+// service's chat aren't renames.
+func (ur *UnRustleLogs) recentRenames(u *User, d time.Duration) ([]IdentityAlias, error) {
+	var aliases []IdentityAlias
+	err := ur.db.Where("service = ? and user_id = ?", u.Service, u.UserID).Order("first_seen asc").Find(&aliases).Error
+	if err != nil {
+		return nil, err
+	}
+	var renames []IdentityAlias
+	var first time.Time
+	for _, a := range aliases {
+		if a.Kind == AliasEmail || strings.HasPrefix(a.Kind, AliasChat) {
+			continue
+		}
+		if first.IsZero() {
+			first = a.FirstSeen
+		}
+		if a.FirstSeen.After(first) && time.Since(a.FirstSeen) < d {
+			renames = append(renames, a)
+		}
+	}
+	return renames, nil
+}
+
+// nameUsedElsewhere reports whether an identity outside the person was ever
+// seen with name on service, in its chat included.
+func (ur *UnRustleLogs) nameUsedElsewhere(personID, service, name string) (bool, error) {
+	var count int
+	err := ur.db.Table("identity_aliases").
+		Joins("join users on users.service = identity_aliases.service and users.user_id = identity_aliases.user_id").
+		Where("((identity_aliases.service = ? and identity_aliases.kind not like ?) or identity_aliases.kind = ?) and identity_aliases.kind <> ? and lower(identity_aliases.value) = ? and users.person_id <> ?",
+			service, AliasChat+"%", AliasChat+service, AliasEmail, strings.ToLower(name), personID).
+		Count(&count).Error
+	return count > 0, err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keys are refetched after this even if every kid is known
+	jwksMaxAge = time.Hour
+	// unknown kids only trigger a refetch this often
+	jwksMinRefresh = time.Minute
+)
+
+var errUnknownKey = errors.New("id_token is signed with an unknown key")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// jwksCache keeps the signing keys of an identity provider. Providers rotate
+// keys by publishing the new one first, so an unknown kid refetches the set.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// attempted is the last refresh, failed ones included
+	attempted time.Time
+	err       error
+}
+
+func newJWKSCache(url string, client *http.Client) *jwksCache {
+	return &jwksCache{url: url, client: client}
+}
+
+// key returns the rsa key with the given kid. Refreshes are tried at most
+// every jwksMinRefresh, while they fail known keys are used anyway so an
+// outage at the provider doesn't stop every login.
+func (c *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k, ok := c.keys[kid]
+	if ok && time.Since(c.fetched) < jwksMaxAge {
+		return k, nil
+	}
+	if time.Since(c.attempted) >= jwksMinRefresh {
+		c.attempted = time.Now()
+		c.err = c.refresh(ctx)
+		if c.err == nil {
+			k, ok = c.keys[kid]
+		} else if ok {
+			logrus.Warnf("refreshing %s failed, using the cached key %s: %v", c.url, kid, c.err)
+		}
+	}
+	switch {
+	case ok:
+		return k, nil
+	case c.err != nil:
+		return nil, c.err
+	}
+	return nil, errUnknownKey
+}
+
+func (c *jwksCache) refresh(ctx context.Context) error {
+	req, err := http.NewRequest("GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", c.url, resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pub, err := k.rsaKey()
+		if err != nil {
+			return fmt.Errorf("key %s of %s: %v", k.Kid, c.url, err)
+		}
+		keys[k.Kid] = pub
+	}
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+func (k *jsonWebKey) rsaKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid rsa key")
+	}
+	exp := 0
+	for _, b := range e {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, nil
+}
+
+// idTokenCheck is what an id_token has to match.
+type idTokenCheck struct {
+	Issuer   string
+	Audience string
+	Nonce    string
+}
+
+// verifyIDToken checks signature, issuer, audience, expiry and nonce of an
+// OpenID Connect id_token and returns its claims.
+func verifyIDToken(ctx context.Context, raw string, keys *jwksCache, check idTokenCheck) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		// only RS256 is mandatory for providers, anything else is refused
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected id_token algorithm %v", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return keys.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != check.Issuer {
+		return nil, fmt.Errorf("id_token issuer %q is not %q", iss, check.Issuer)
+	}
+	if !claimsAudience(claims, check.Audience) {
+		return nil, fmt.Errorf("id_token is not meant for %q", check.Audience)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id_token has no expiry")
+	}
+	if nonce, _ := claims["nonce"].(string); check.Nonce != "" && nonce != check.Nonce {
+		return nil, errors.New("id_token nonce doesn't match")
+	}
+	return claims, nil
+}
+
+// claimsAudience reports whether aud, a string or a list, contains audience.
+func claimsAudience(claims jwt.MapClaims, audience string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns a claim as string, numbers are formatted.
+func claimString(claims jwt.MapClaims, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	}
+	return ""
+}
+
+// claimBool returns a boolean claim, some providers send "true" as string.
+func claimBool(claims jwt.MapClaims, name string) bool {
+	switch v := claims[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
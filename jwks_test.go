@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJWK(t *testing.T, kid string) jsonWebKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func TestJWKSCacheRefresh(t *testing.T) {
+	var mu sync.Mutex
+	published := []jsonWebKey{testJWK(t, "old")}
+	down := false
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if down {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": published})
+	}))
+	defer srv.Close()
+	cache := newJWKSCache(srv.URL, srv.Client())
+	newKey := testJWK(t, "new")
+
+	// age moves the last fetch and refresh attempt into the past
+	age := func(fetched, attempted time.Duration) func() {
+		return func() {
+			cache.fetched = time.Now().Add(-fetched)
+			cache.attempted = time.Now().Add(-attempted)
+		}
+	}
+	steps := []struct {
+		name    string
+		before  func()
+		kid     string
+		ok      bool
+		fetches int
+	}{
+		{name: "first lookup fetches", kid: "old", ok: true, fetches: 1},
+		{name: "fresh keys are cached", kid: "old", ok: true, fetches: 1},
+		{
+			name:    "stale key is used while the provider is down",
+			before:  func() { age(2*jwksMaxAge, 2*jwksMaxAge)(); down = true },
+			kid:     "old",
+			ok:      true,
+			fetches: 2,
+		},
+		{name: "failed refreshes aren't retried right away", kid: "old", ok: true, fetches: 2},
+		{name: "unknown key while the provider is down", kid: "new", fetches: 2},
+		{
+			name:    "rotated key after the provider is back",
+			before:  func() { age(2*jwksMaxAge, 2*jwksMinRefresh)(); down = false; published = []jsonWebKey{newKey} },
+			kid:     "new",
+			ok:      true,
+			fetches: 3,
+		},
+		{name: "retired key is gone", kid: "old", fetches: 3},
+		{
+			name:    "unknown kids refetch at most every jwksMinRefresh",
+			before:  age(0, jwksMinRefresh/2),
+			kid:     "other",
+			fetches: 3,
+		},
+	}
+	for _, st := range steps {
+		mu.Lock()
+		if st.before != nil {
+			st.before()
+		}
+		mu.Unlock()
+		k, err := cache.key(context.Background(), st.kid)
+		if (err == nil) != st.ok || (st.ok && k == nil) {
+			t.Errorf("%s: key %v, error %v, want ok %v", st.name, k, err, st.ok)
+		}
+		mu.Lock()
+		if fetches != st.fetches {
+			t.Errorf("%s: %d fetches, want %d", st.name, fetches, st.fetches)
+		}
+		mu.Unlock()
+	}
+}
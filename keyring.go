@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// AlgEdDSA is the jwt name of ed25519 signatures
+	AlgEdDSA = "EdDSA"
+
+	defaultIssuer = "unrustlelogs"
+	loginAudience = "login"
+	// maxTokenLifetime is how long the longest lived tokens we sign stay
+	// valid, retired keys have to verify them until then
+	maxTokenLifetime = statusTokenTTL
+
+	hmacKeySize = 32
+	rsaKeyBits  = 2048
+)
+
+var errTokenClaims = errors.New("token has the wrong issuer, audience or no expiry")
+
+// JWTConfig picks the keys sessions and links are signed with.
+type JWTConfig struct {
+	Issuer string
+	// Keyring is the file "unrustlelogs keys" manages
+	Keyring string
+	// Algorithms tokens may be signed with, defaults to the ones the
+	// keyring uses
+	Algorithms []string
+}
+
+// signingMethodEdDSA signs with ed25519, jwt-go doesn't know it yet.
+type signingMethodEdDSA struct{}
+
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(priv, []byte(signingString))), nil
+}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgEdDSA, func() jwt.SigningMethod {
+		return &signingMethodEdDSA{}
+	})
+}
+
+// keyringFile is the file on disk.
+type keyringFile struct {
+	Keys []jwtKey `toml:"key"`
+}
+
+// jwtKey is a stored signing key. Retired keys only verify, asymmetric
+// ones lose their private half when they are retired.
+type jwtKey struct {
+	ID        string     `toml:"kid"`
+	Alg       string     `toml:"alg"`
+	CreatedAt time.Time  `toml:"created_at"`
+	RetiredAt *time.Time `toml:"retired_at"`
+	// Secret is the base64 key of HS256 keys
+	Secret     string `toml:"secret,omitempty"`
+	PrivateKey string `toml:"private_key,omitempty"`
+	PublicKey  string `toml:"public_key,omitempty"`
+}
+
+// ringKey is a parsed jwtKey.
+type ringKey struct {
+	jwtKey
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type keyring struct {
+	issuer string
+	algs   []string
+	keys   map[string]*ringKey
+	signer *ringKey
+	// legacy is server.jwt_secret, it verifies tokens without a kid
+	legacy *ringKey
+}
+
+func (r *keyring) lookup(kid string) (*ringKey, bool) {
+	if kid == "" {
+		return r.legacy, r.legacy != nil
+	}
+	k, ok := r.keys[kid]
+	return k, ok
+}
+
+// parseKey decodes the key material of k.
+func parseKey(k jwtKey) (*ringKey, error) {
+	rk := &ringKey{jwtKey: k, method: jwt.GetSigningMethod(k.Alg)}
+	switch k.Alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret, err := base64.StdEncoding.DecodeString(k.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.ID, err)
+		}
+		if len(secret) < hmacKeySize {
+			return nil, fmt.Errorf("key %s: secret is shorter than %d bytes", k.ID, hmacKeySize)
+		}
+		rk.signKey, rk.verifyKey = secret, secret
+		return rk, nil
+	case jwt.SigningMethodRS256.Alg(), AlgEdDSA:
+	default:
+		return nil, fmt.Errorf("key %s: unsupported algorithm %q", k.ID, k.Alg)
+	}
+
+	if k.PrivateKey != "" {
+		der, err := pemBytes(k.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.ID, err)
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.ID, err)
+		}
+		switch priv := priv.(type) {
+		case *rsa.PrivateKey:
+			rk.signKey, rk.verifyKey = priv, &priv.PublicKey
+		case ed25519.PrivateKey:
+			rk.signKey, rk.verifyKey = priv, priv.Public()
+		}
+	} else if k.PublicKey != "" {
+		der, err := pemBytes(k.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.ID, err)
+		}
+		if rk.verifyKey, err = x509.ParsePKIXPublicKey(der); err != nil {
+			return nil, fmt.Errorf("key %s: %v", k.ID, err)
+		}
+	}
+
+	ok := false
+	switch rk.verifyKey.(type) {
+	case *rsa.PublicKey:
+		ok = k.Alg == jwt.SigningMethodRS256.Alg()
+	case ed25519.PublicKey:
+		ok = k.Alg == AlgEdDSA
+	}
+	if !ok {
+		return nil, fmt.Errorf("key %s: missing or not a %s key", k.ID, k.Alg)
+	}
+	return rk, nil
+}
+
+// signingKey returns the newest key that isn't retired and can sign.
+func signingKey(keys []jwtKey) *jwtKey {
+	var signer *jwtKey
+	for i, k := range keys {
+		canSign := k.Secret != "" || k.PrivateKey != ""
+		if k.RetiredAt == nil && canSign && (signer == nil || k.CreatedAt.After(signer.CreatedAt)) {
+			signer = &keys[i]
+		}
+	}
+	return signer
+}
+
+func pemBytes(s string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	return block.Bytes, nil
+}
+
+// newKeyring builds the keyring from the config and the keys on disk.
+func newKeyring(cfg JWTConfig, legacySecret string, stored []jwtKey) (*keyring, error) {
+	ring := &keyring{
+		issuer: cfg.Issuer,
+		keys:   make(map[string]*ringKey),
+	}
+	if ring.issuer == "" {
+		ring.issuer = defaultIssuer
+	}
+	if legacySecret != "" {
+		ring.legacy = &ringKey{
+			jwtKey:    jwtKey{Alg: jwt.SigningMethodHS256.Alg()},
+			method:    jwt.SigningMethodHS256,
+			signKey:   []byte(legacySecret),
+			verifyKey: []byte(legacySecret),
+		}
+	}
+
+	used := map[string]bool{}
+	for _, k := range stored {
+		rk, err := parseKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ring.keys[k.ID]; ok || k.ID == "" {
+			return nil, fmt.Errorf("key id %q is empty or used twice", k.ID)
+		}
+		ring.keys[k.ID] = rk
+		used[k.Alg] = true
+	}
+	if k := signingKey(stored); k != nil {
+		ring.signer = ring.keys[k.ID]
+	}
+	if ring.legacy != nil {
+		used[ring.legacy.Alg] = true
+	}
+	if ring.signer == nil {
+		ring.signer = ring.legacy
+	}
+	if ring.signer == nil {
+		return nil, errors.New("no key can sign tokens, run \"unrustlelogs keys add\" or set server.jwt_secret")
+	}
+
+	ring.algs = cfg.Algorithms
+	if len(ring.algs) == 0 {
+		for alg := range used {
+			ring.algs = append(ring.algs, alg)
+		}
+		sort.Strings(ring.algs)
+	}
+	for _, alg := range ring.algs {
+		if m := jwt.GetSigningMethod(alg); m == nil || m == jwt.SigningMethodNone {
+			return nil, fmt.Errorf("unsupported jwt algorithm %q", alg)
+		}
+	}
+	allowed := false
+	for _, alg := range ring.algs {
+		allowed = allowed || alg == ring.signer.Alg
+	}
+	if !allowed {
+		return nil, fmt.Errorf("key %q signs with %s which jwt.algorithms doesn't allow", ring.signer.ID, ring.signer.Alg)
+	}
+	return ring, nil
+}
+
+// readKeyring reads the keys in file, a missing file has none.
+func readKeyring(file string) ([]jwtKey, error) {
+	var kf keyringFile
+	if file == "" {
+		return nil, nil
+	}
+	if _, err := toml.DecodeFile(file, &kf); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return kf.Keys, nil
+}
+
+// writeKeyring replaces file, only the owner may read it.
+func writeKeyring(file string, keys []jwtKey) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".keyring")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := toml.NewEncoder(tmp).Encode(keyringFile{Keys: keys}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// LoadKeyring reads the signing keys, they are fixed until a restart.
+func (ur *UnRustleLogs) LoadKeyring() error {
+	stored, err := readKeyring(ur.config.JWT.Keyring)
+	if err != nil {
+		return err
+	}
+	ring, err := newKeyring(ur.config.JWT, ur.config.Server.JWTSecret, stored)
+	if err != nil {
+		return err
+	}
+	ur.keyring = ring
+	return nil
+}
+
+// keys returns the keyring, before LoadKeyring that is only the legacy
+// secret.
+func (ur *UnRustleLogs) keys() *keyring {
+	if ur.keyring == nil {
+		ring, err := newKeyring(ur.config.JWT, ur.config.Server.JWTSecret, nil)
+		if err != nil {
+			return &keyring{issuer: defaultIssuer}
+		}
+		return ring
+	}
+	return ur.keyring
+}
+
+// standardClaims are the claims every token we sign carries.
+func (ur *UnRustleLogs) standardClaims(audience string, expires time.Time) jwt.StandardClaims {
+	return jwt.StandardClaims{
+		Issuer:    ur.keys().issuer,
+		Audience:  audience,
+		IssuedAt:  time.Now().Unix(),
+		ExpiresAt: expires.Unix(),
+	}
+}
+
+// signJWT signs claims with the newest key of the keyring.
+func (ur *UnRustleLogs) signJWT(claims jwt.Claims) (string, error) {
+	k := ur.keys().signer
+	if k == nil {
+		return "", errors.New("no key can sign tokens")
+	}
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.signKey)
+}
+
+// audienceClaims are claims embedding jwt.StandardClaims.
+type audienceClaims interface {
+	jwt.Claims
+	VerifyAudience(cmp string, req bool) bool
+	VerifyIssuer(cmp string, req bool) bool
+	VerifyExpiresAt(cmp int64, req bool) bool
+}
+
+// parseJWT verifies raw with the key named by its kid and fills claims.
+// The algorithm has to be allowed and match the key, the token has to be
+// ours and meant for audience.
+func (ur *UnRustleLogs) parseJWT(raw string, claims audienceClaims, audience string) error {
+	ring := ur.keys()
+	parser := jwt.Parser{ValidMethods: ring.algs}
+	var key *ringKey
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := ring.lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		if t.Method.Alg() != k.Alg {
+			return nil, fmt.Errorf("key %q doesn't sign with %s", kid, t.Method.Alg())
+		}
+		key = k
+		return k.verifyKey, nil
+	})
+	if err != nil {
+		return err
+	}
+	// tokens from before the keyring have no issuer and login cookies no
+	// audience either
+	strict := key.ID != ""
+	if !claims.VerifyIssuer(ring.issuer, strict) ||
+		!claims.VerifyAudience(audience, strict) ||
+		!claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return errTokenClaims
+	}
+	return nil
+}
+
+// generateKey creates a new key for alg.
+func generateKey(alg string) (jwtKey, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return jwtKey{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	k := jwtKey{
+		ID:        now.Format("20060102") + "-" + hex.EncodeToString(id),
+		Alg:       alg,
+		CreatedAt: now,
+	}
+
+	var priv interface{}
+	var pub interface{}
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret := make([]byte, hmacKeySize)
+		if _, err := rand.Read(secret); err != nil {
+			return jwtKey{}, err
+		}
+		k.Secret = base64.StdEncoding.EncodeToString(secret)
+		return k, nil
+	case jwt.SigningMethodRS256.Alg():
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		priv, pub = key, &key.PublicKey
+	case AlgEdDSA:
+		p, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return jwtKey{}, err
+		}
+		priv, pub = key, p
+	default:
+		return jwtKey{}, fmt.Errorf("unsupported algorithm %q, use EdDSA, RS256 or HS256", alg)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return jwtKey{}, err
+	}
+	k.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if der, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		return jwtKey{}, err
+	}
+	k.PublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return k, nil
+}
+
+func (ur *UnRustleLogs) keysCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: keys add|retire|remove|list [flags]")
+	}
+	fs := flag.NewFlagSet("keys "+args[0], flag.ContinueOnError)
+	alg := fs.String("alg", AlgEdDSA, "algorithm of the new key, one of EdDSA, RS256, HS256")
+	kid := fs.String("kid", "", "id of the key")
+	force := fs.Bool("force", false, "retire the last signing key or remove a key tokens may still use")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	file := ur.config.JWT.Keyring
+	if file == "" {
+		return fmt.Errorf("set keyring in the [jwt] section of the config first")
+	}
+	keys, err := readKeyring(file)
+	if err != nil {
+		return err
+	}
+	// broken keys have to be fixed by hand before we touch the file
+	for _, k := range keys {
+		if _, err := parseKey(k); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		for _, k := range keys {
+			state := "verify"
+			if k.RetiredAt != nil {
+				state = "retired " + k.RetiredAt.Format("2006-01-02")
+			} else if signer := signingKey(keys); signer != nil && signer.ID == k.ID {
+				state = "signing"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", k.ID, k.Alg, k.CreatedAt.Format("2006-01-02"), state)
+		}
+		return nil
+	case "add":
+		k, err := generateKey(*alg)
+		if err != nil {
+			return err
+		}
+		if err := writeKeyring(file, append(keys, k)); err != nil {
+			return err
+		}
+		ur.audit(cliActor, AuditKeyAdd, "key:"+k.ID, k.Alg)
+		fmt.Printf("added %s key %s, restart the server to sign with it\n", k.Alg, k.ID)
+		return nil
+	case "retire", "remove":
+	default:
+		return fmt.Errorf("unknown keys command %q", args[0])
+	}
+
+	i := -1
+	for j, k := range keys {
+		if k.ID == *kid {
+			i = j
+		}
+	}
+	if i < 0 {
+		fs.Usage()
+		return fmt.Errorf("key %q not found", *kid)
+	}
+	k := &keys[i]
+
+	if args[0] == "retire" {
+		if k.RetiredAt != nil {
+			return nil
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		k.RetiredAt = &now
+		if k.Alg != jwt.SigningMethodHS256.Alg() {
+			k.PrivateKey = ""
+		}
+		if signingKey(keys) == nil && !*force {
+			return fmt.Errorf("%s is the last key that can sign, add a new one first", k.ID)
+		}
+		if err := writeKeyring(file, keys); err != nil {
+			return err
+		}
+		ur.audit(cliActor, AuditKeyRetire, "key:"+k.ID, k.Alg)
+		fmt.Printf("retired %s, it verifies tokens until %s\n", k.ID, now.Add(maxTokenLifetime).Format("2006-01-02"))
+		return nil
+	}
+
+	if !*force && (k.RetiredAt == nil || time.Since(*k.RetiredAt) < maxTokenLifetime) {
+		return fmt.Errorf("tokens signed with %s may still be valid, retire it and wait until they expire", k.ID)
+	}
+	removed := *k
+	if err := writeKeyring(file, append(keys[:i], keys[i+1:]...)); err != nil {
+		return err
+	}
+	ur.audit(cliActor, AuditKeyRemove, "key:"+removed.ID, removed.Alg)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+func testKey(t *testing.T, alg string) jwtKey {
+	t.Helper()
+	k, err := generateKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestNewKeyringAlgorithms(t *testing.T) {
+	ed := testKey(t, AlgEdDSA)
+	mislabeled := ed
+	mislabeled.Alg = jwt.SigningMethodRS256.Alg()
+
+	tests := []struct {
+		name   string
+		algs   []string
+		legacy string
+		keys   []jwtKey
+		algsIs []string
+		err    string
+	}{
+		{name: "defaults to the algorithms in use", legacy: testSecret, keys: []jwtKey{ed}, algsIs: []string{AlgEdDSA, "HS256"}},
+		{name: "allowed signer", algs: []string{AlgEdDSA}, keys: []jwtKey{ed}, algsIs: []string{AlgEdDSA}},
+		{name: "none", algs: []string{AlgEdDSA, "none"}, keys: []jwtKey{ed}, err: `unsupported jwt algorithm "none"`},
+		{name: "unknown algorithm", algs: []string{AlgEdDSA, "XS256"}, keys: []jwtKey{ed}, err: `unsupported jwt algorithm "XS256"`},
+		{name: "signer not allowed", algs: []string{"HS256"}, keys: []jwtKey{ed}, err: "which jwt.algorithms doesn't allow"},
+		{name: "legacy signer not allowed", algs: []string{AlgEdDSA}, legacy: testSecret, err: "which jwt.algorithms doesn't allow"},
+		{name: "key of another algorithm", keys: []jwtKey{mislabeled}, err: "not a RS256 key"},
+		{name: "no signer", err: "no key can sign tokens"},
+	}
+	for _, tt := range tests {
+		ring, err := newKeyring(JWTConfig{Algorithms: tt.algs}, tt.legacy, tt.keys)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error is %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if strings.Join(ring.algs, ",") != strings.Join(tt.algsIs, ",") {
+			t.Errorf("%s: algorithms %v, want %v", tt.name, ring.algs, tt.algsIs)
+		}
+	}
+}
+
+func TestParseJWTAlgorithms(t *testing.T) {
+	ed := testKey(t, AlgEdDSA)
+	edKey, err := parseKey(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.StandardClaims{
+		Issuer:    defaultIssuer,
+		Audience:  loginAudience,
+		ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name  string
+		algs  []string
+		token string
+		ok    bool
+	}{
+		{name: "signed by the keyring", token: sign(edKey.method, ed.ID, edKey.signKey), ok: true},
+		{name: "legacy secret", token: sign(jwt.SigningMethodHS256, "", []byte(testSecret)), ok: true},
+		{name: "legacy secret no longer allowed", algs: []string{AlgEdDSA}, token: sign(jwt.SigningMethodHS256, "", []byte(testSecret))},
+		{name: "unsigned", token: sign(jwt.SigningMethodNone, ed.ID, jwt.UnsafeAllowNoneSignatureType)},
+		{name: "public key as hmac secret", token: sign(jwt.SigningMethodHS256, ed.ID, []byte(edKey.verifyKey.(ed25519.PublicKey)))},
+		{name: "algorithm the ring doesn't use", token: sign(jwt.SigningMethodHS512, "", []byte(testSecret))},
+		{name: "unknown kid", token: sign(edKey.method, "other", edKey.signKey)},
+	}
+	for _, tt := range tests {
+		ring, err := newKeyring(JWTConfig{Algorithms: tt.algs}, testSecret, []jwtKey{ed})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ur := NewUnRustleLogs()
+		ur.config = &Config{}
+		ur.keyring = ring
+		err = ur.parseJWT(tt.token, &jwt.StandardClaims{}, loginAudience)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error is %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
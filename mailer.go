@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Mailer sends plain text mails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// smtpMailer delivers mails through an smtp server.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, buildMail(m.from, to, subject, body))
+}
+
+// maildirMailer drops mails into a maildir instead of sending them,
+// meant for running the service locally.
+type maildirMailer struct {
+	dir  string
+	from string
+}
+
+func (m *maildirMailer) Send(to, subject, body string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%d.%s.unrustlelogs", time.Now().UnixNano(), uniuri.New())
+	tmp := filepath.Join(m.dir, "tmp", name)
+	if err := ioutil.WriteFile(tmp, buildMail(m.from, to, subject, body), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(m.dir, "new", name))
+}
+
+func buildMail(from, to, subject, body string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@unrustlelogs>\r\n", uniuri.NewLen(32))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return b.Bytes()
+}
+
+func (ur *UnRustleLogs) setupMailer() error {
+	cfg := ur.config.Mail
+	switch cfg.Backend {
+	case "smtp":
+		m := &smtpMailer{
+			addr: net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(cfg.SMTP.Port)),
+			from: cfg.From,
+		}
+		if cfg.SMTP.Username != "" {
+			m.auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)
+		}
+		ur.mailer = m
+	case "maildir", "":
+		dir := cfg.Maildir
+		if dir == "" {
+			dir = "mail"
+		}
+		ur.mailer = &maildirMailer{dir: dir, from: cfg.From}
+	default:
+		return fmt.Errorf("unknown mail backend %q", cfg.Backend)
+	}
+	return nil
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -10,8 +12,6 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
-	"github.com/nicklaw5/helix"
-	"github.com/tensei/dggoauth"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
@@ -23,22 +23,18 @@ import (
 type UnRustleLogs struct {
 	config *Config
 	db     *gorm.DB
+	mailer Mailer
 
-	dggHTTPClient  *http.Client
-	dggOauthClient *dggoauth.Client
-	dggStates      map[string]*state
-	dggStateMutex  sync.RWMutex
+	auditMutex   sync.Mutex
+	statusBroker *statusBroker
 
-	twitchHTTPClient *http.Client
-	twitchAPIClient  *helix.Client
-	twitchStates     map[string]struct{}
-	twitchStateMutex sync.RWMutex
-}
+	keyring *keyring
+
+	providers []Provider
+	states    StateStore
 
-type state struct {
-	service  string
-	verifier string
-	time     time.Time
+	limiter        RateLimiter
+	trustedProxies []*net.IPNet
 }
 
 const (
@@ -46,6 +42,8 @@ const (
 	TWITCHSERVICE = "twitch"
 	// DESTINYGGSERVICE ...
 	DESTINYGGSERVICE = "destinygg"
+	// DISCORDSERVICE ...
+	DISCORDSERVICE = "discord"
 )
 
 // jwtCustomClaims are custom claims extending default ones.
@@ -58,41 +56,74 @@ func main() {
 	gin.SetMode(gin.ReleaseMode)
 	rustle := NewUnRustleLogs()
 	rustle.LoadConfig("config.toml")
+	if err := rustle.validateStaffConfig(); err != nil {
+		logrus.Fatal(err)
+	}
 
 	rustle.NewDatabase()
-	err := rustle.setupTwitchClient()
+	if err := rustle.syncConfigRoles(); err != nil {
+		logrus.Fatal(err)
+	}
+	if len(os.Args) > 1 {
+		os.Exit(rustle.runCommand(os.Args[1:]))
+	}
+	if err := rustle.LoadKeyring(); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := rustle.setupStateStore(); err != nil {
+		logrus.Fatal(err)
+	}
+	defer rustle.states.Close()
+	if err := rustle.setupRateLimiter(); err != nil {
+		logrus.Fatal(err)
+	}
+	defer rustle.limiter.Close()
+
+	err := rustle.setupProviders()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	err = rustle.setupDestinyggClient()
+	err = rustle.setupMailer()
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	rustle.watchChats(watchCtx)
+
 	router := gin.Default()
 	router.LoadHTMLGlob("templates/*")
+	router.Use(requestIDMiddleware)
+	router.Use(rustle.clientIPMiddleware)
+	router.Use(rustle.csrfMiddleware)
 
 	router.GET("/", rustle.indexHandler)
-	router.GET("/verify", rustle.verifyHandler)
+	router.GET("/verify", rustle.rateLimit(limitVerify, ""), rustle.verifyHandler)
+	router.GET("/email/verify", rustle.rateLimit(limitEmail, ""), rustle.emailVerifyHandler)
+	router.POST("/email/verify", rustle.rateLimit(limitEmail, ""), rustle.emailConfirmHandler)
+	router.GET("/status", rustle.rateLimit(limitVerify, ""), rustle.statusHandler)
+	router.GET("/status/events", rustle.statusEventsHandler)
 	router.GET("/robots.txt", func(c *gin.Context) {
 		c.String(200, "User-agent: *\nDisallow: /")
 	})
 
-	twitch := router.Group("/twitch")
-	{
-		twitch.GET("/", rustle.TwitchIndexHandle)
-		twitch.GET("/login", rustle.TwitchLoginHandle)
-		twitch.GET("/logout", rustle.TwitchLogoutHandle)
-		twitch.GET("/callback", rustle.TwitchCallbackHandle)
+	for _, p := range rustle.providers {
+		rustle.registerProvider(router, p)
 	}
 
-	dgg := router.Group("/dgg")
+	admin := router.Group("/admin", rustle.requirePermission(PermViewRequests))
 	{
-		dgg.GET("/", rustle.DestinyggIndexHandle)
-		dgg.GET("/login", rustle.DestinyggLoginHandle)
-		dgg.GET("/logout", rustle.DestinyggLogoutHandle)
-		dgg.GET("/callback", rustle.DestinyggCallbackHandle)
+		admin.GET("/", func(c *gin.Context) {
+			c.Redirect(http.StatusFound, "/admin/requests")
+		})
+		admin.GET("/requests", rustle.adminRequestsHandler)
+		admin.GET("/requests/:id", rustle.adminRequestHandler)
+		admin.POST("/requests/:id/:action", rustle.adminRequestActionHandler)
+		admin.GET("/audit.jsonl", rustle.requirePermission(PermViewAudit), rustle.auditExportHandler)
+		// expvar includes the command line, admins only
+		admin.GET("/debug/vars", rustle.requirePermission(PermViewMetrics), gin.WrapH(expvar.Handler()))
 	}
 
 	router.Static("/assets", "./assets")
@@ -134,201 +165,38 @@ func main() {
 // NewUnRustleLogs ...
 func NewUnRustleLogs() *UnRustleLogs {
 	return &UnRustleLogs{
-		dggHTTPClient:    &http.Client{},
-		dggStates:        make(map[string]*state),
-		twitchHTTPClient: &http.Client{},
-		twitchStates:     make(map[string]struct{}),
+		statusBroker: newStatusBroker(),
+		states:       newMemoryStateStore(defaultMaxStates),
+		limiter:      newMemoryRateLimiter(defaultMaxBuckets),
 	}
 }
 
-// Payload ...
-type Payload struct {
-	Twitch struct {
-		ID       string
-		Name     string
-		Email    string
-		LoggedIn bool
-	}
-	Destinygg struct {
-		ID       string
-		Name     string
-		LoggedIn bool
-	}
+// IndexPayload ...
+type IndexPayload struct {
+	Providers []ProviderInfo
 }
 
 func (ur *UnRustleLogs) indexHandler(c *gin.Context) {
-	c.HTML(http.StatusOK, "index.tmpl", nil)
-}
-
-// TwitchIndexHandle ...
-func (ur *UnRustleLogs) TwitchIndexHandle(c *gin.Context) {
-	payload := Payload{}
-	twitch, ok := ur.getUserFromJWT(c, ur.config.Twitch.Cookie)
-	if ok {
-		payload.Twitch.Name = twitch.DisplayName
-		payload.Twitch.Email = twitch.Email
-		payload.Twitch.LoggedIn = true
-		payload.Twitch.ID = twitch.ID
-	}
-	c.HTML(http.StatusOK, "twitch.tmpl", payload)
-}
-
-// DestinyggIndexHandle ...
-func (ur *UnRustleLogs) DestinyggIndexHandle(c *gin.Context) {
-	payload := Payload{}
-	dgg, ok := ur.getUserFromJWT(c, ur.config.Destinygg.Cookie)
-	if ok {
-		payload.Destinygg.Name = dgg.DisplayName
-		payload.Destinygg.LoggedIn = true
-		payload.Destinygg.ID = dgg.ID
-	}
-	c.HTML(http.StatusOK, "destinygg.tmpl", payload)
-}
-
-// VerifyPayload ...
-type VerifyPayload struct {
-	UserID  string
-	Name    string
-	Email   string
-	Valid   bool
-	JWT     string
-	Service string
-	ID      string
+	c.HTML(http.StatusOK, "index.tmpl", IndexPayload{Providers: ur.providerInfos()})
 }
 
+// verifyHandler sends the old verify links from support emails to the
+// requests of that user in the admin console.
 func (ur *UnRustleLogs) verifyHandler(c *gin.Context) {
-	payload := VerifyPayload{}
-	if id := c.Query("id"); id != "" {
-		id = strings.TrimSpace(id)
-		// make sure the uuid is valid
-		uid, err := uuid.Parse(id)
-		if err != nil {
-			c.HTML(http.StatusBadRequest, "verify.tmpl", payload)
-			return
-		}
-		user, ok := ur.GetUser(uid.String())
-		if !ok {
-			c.HTML(http.StatusBadRequest, "verify.tmpl", payload)
-			return
-		}
-		payload.UserID = user.UserID
-		payload.Name = user.Name
-		payload.Email = user.Email
-		payload.Valid = true
-		payload.Service = user.Service
-		payload.ID = uid.String()
-	}
-
-	c.HTML(http.StatusOK, "verify.tmpl", payload)
-}
-
-func (ur *UnRustleLogs) getUserFromJWT(c *gin.Context, cookiename string) (*User, bool) {
-	cookie, err := c.Cookie(cookiename)
+	id := strings.TrimSpace(c.Query("id"))
+	uid, err := uuid.Parse(id)
 	if err != nil {
-		return nil, false
+		c.Redirect(http.StatusFound, "/admin/requests")
+		return
 	}
-	token, err := jwt.ParseWithClaims(cookie, &jwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(ur.config.Server.JWTSecret), nil
-	})
-	if err != nil {
-		logrus.Error(err)
-		ur.deleteCookie(c, cookie)
-		return nil, false
-	}
-
-	if claims, ok := token.Claims.(*jwtClaims); ok && token.Valid {
-		// idk if i have to manually check if the jwt is expired or not
-		// might be that .Valid is only true if it's not expired also
-		now := time.Now()
-		expires := time.Unix(claims.ExpiresAt, 0)
-		if now.After(expires) {
-			ur.deleteCookie(c, cookie)
-			return nil, false
-		}
-		return ur.GetUser(claims.ID)
+	if s, ok := ur.currentStaff(c); ok && s.Can(PermViewEmail) {
+		ur.audit(ur.staffActor(c), AuditPIIView, "user:"+uid.String(), "verify link")
 	}
-	return nil, false
-}
-
-func (ur *UnRustleLogs) parseJWT(jwtString string) (*jwtClaims, bool) {
-	token, err := jwt.ParseWithClaims(jwtString, &jwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(ur.config.Server.JWTSecret), nil
-	})
-	if err != nil {
-		logrus.Error(err)
-		return nil, false
-	}
-
-	if claims, ok := token.Claims.(*jwtClaims); ok && token.Valid {
-		return claims, true
-	}
-	return nil, false
-}
-
-func (ur *UnRustleLogs) addDggState(s, verifier string) {
-	ur.dggStateMutex.Lock()
-	defer ur.dggStateMutex.Unlock()
-	ur.dggStates[s] = &state{
-		verifier: verifier,
-		service:  DESTINYGGSERVICE,
-		time:     time.Now().UTC(),
-	}
-	// delete dgg state after 5 minutes
-	go func() {
-		time.Sleep(time.Minute * 5)
-		ur.deleteDggState(s)
-	}()
+	c.Redirect(http.StatusFound, "/admin/requests?user="+uid.String())
 }
 
-func (ur *UnRustleLogs) hasDggState(state string) (string, bool) {
-	if strings.TrimSpace(state) == "" {
-		return "", false
-	}
-	ur.dggStateMutex.RLock()
-	defer ur.dggStateMutex.RUnlock()
-	s, ok := ur.dggStates[state]
-	if !ok {
-		return "", false
-	}
-	return s.verifier, ok
-}
-
-func (ur *UnRustleLogs) deleteDggState(state string) {
-	ur.dggStateMutex.Lock()
-	defer ur.dggStateMutex.Unlock()
-	_, ok := ur.dggStates[state]
-	if ok {
-		logrus.Infof("deleting dgg state %s", state)
-		delete(ur.dggStates, state)
-	}
-}
-
-func (ur *UnRustleLogs) addTwitchState(s string) {
-	ur.twitchStateMutex.Lock()
-	defer ur.twitchStateMutex.Unlock()
-	ur.twitchStates[s] = struct{}{}
-	go func() {
-		time.Sleep(time.Minute * 5)
-		ur.deleteTwitchState(s)
-	}()
-}
-
-func (ur *UnRustleLogs) hasTwitchState(state string) bool {
-	if strings.TrimSpace(state) == "" {
-		return false
-	}
-	ur.twitchStateMutex.RLock()
-	defer ur.twitchStateMutex.RUnlock()
-	_, ok := ur.twitchStates[state]
-	return ok
-}
-
-func (ur *UnRustleLogs) deleteTwitchState(state string) {
-	ur.twitchStateMutex.Lock()
-	defer ur.twitchStateMutex.Unlock()
-	_, ok := ur.twitchStates[state]
-	if ok {
-		logrus.Infof("deleting twitch state %s", state)
-		delete(ur.twitchStates, state)
-	}
+// getUserFromJWT returns the user logged in with the cookie.
+func (ur *UnRustleLogs) getUserFromJWT(c *gin.Context, cookiename string) (*User, bool) {
+	_, user, ok := ur.currentSession(c, cookiename)
+	return user, ok
 }
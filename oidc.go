@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/dgrijalva/jwt-go"
+)
+
+// discovery documents are refetched after this
+const oidcDiscoveryMaxAge = time.Hour * 24
+
+// OIDCConfig configures a generic OpenID Connect provider.
+type OIDCConfig struct {
+	// Service is stored on users and is the route of the provider
+	Service      string
+	Title        string
+	Icon         string
+	Issuer       string
+	ClientID     string `toml:"client_id"`
+	ClientSecret string `toml:"client_secret"`
+	RedirectURL  string `toml:"redirect_url"`
+	Scopes       []string
+	Cookie       string
+	// Claims maps claims of the id_token or userinfo onto the user
+	Claims struct {
+		UserID      string `toml:"user_id"`
+		Name        string
+		DisplayName string `toml:"display_name"`
+		Email       string
+	}
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"`
+}
+
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	fetched   time.Time
+	keys      *jwksCache
+}
+
+func newOIDCProvider(config OIDCConfig) (*oidcProvider, error) {
+	if config.Service == "" || config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("oidc provider %q needs service, issuer, client_id and redirect_url", config.Service)
+	}
+	if config.Title == "" {
+		config.Title = config.Service
+	}
+	if config.Cookie == "" {
+		config.Cookie = config.Service
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.Claims.UserID == "" {
+		config.Claims.UserID = "sub"
+	}
+	if config.Claims.Name == "" {
+		config.Claims.Name = "preferred_username"
+	}
+	if config.Claims.DisplayName == "" {
+		config.Claims.DisplayName = config.Claims.Name
+	}
+	if config.Claims.Email == "" {
+		config.Claims.Email = "email"
+	}
+	config.Issuer = strings.TrimRight(config.Issuer, "/")
+	return &oidcProvider{config: config, client: newProviderClient(config.Service)}, nil
+}
+
+func (p *oidcProvider) Info() ProviderInfo {
+	return ProviderInfo{
+		Service: p.config.Service,
+		Path:    "/" + p.config.Service,
+		Title:   p.config.Title,
+		Icon:    p.config.Icon,
+		Cookie:  p.config.Cookie,
+		Scopes:  p.config.Scopes,
+	}
+}
+
+// discover returns the cached discovery document of the issuer.
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, *jwksCache, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.fetched) < oidcDiscoveryMaxAge {
+		return p.discovery, p.keys, nil
+	}
+
+	req, err := http.NewRequest("GET", p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, nil, providerError(p.config.Service, "discovery", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(p.config.Service, "discovery", resp); err != nil {
+		return nil, nil, err
+	}
+	var d oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.config.Issuer {
+		return nil, nil, fmt.Errorf("%s discovery is for issuer %q", p.config.Service, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("%s discovery is missing endpoints", p.config.Service)
+	}
+	if p.keys == nil || p.keys.url != d.JWKSURI {
+		p.keys = newJWKSCache(d.JWKSURI, p.client)
+	}
+	p.discovery = &d
+	p.fetched = time.Now()
+	return p.discovery, p.keys, nil
+}
+
+// pkceChallenge is the S256 code challenge of verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *oidcProvider) AuthorizationURL(state string, s *oauthState) (string, error) {
+	d, _, err := p.discover(context.Background())
+	if err != nil {
+		return "", err
+	}
+	s.Nonce = uniuri.NewLen(32)
+	s.Verifier = uniuri.NewLen(64)
+
+	v := url.Values{}
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.config.RedirectURL)
+	v.Set("response_type", "code")
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", s.Nonce)
+	v.Set("code_challenge", pkceChallenge(s.Verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+func (p *oidcProvider) Exchange(ctx context.Context, code string, s *oauthState) (*Token, error) {
+	d, _, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("client_id", p.config.ClientID)
+	form.Set("code_verifier", s.Verifier)
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, providerError(p.config.Service, "token exchange", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(p.config.Service, "token exchange", resp); err != nil {
+		return nil, err
+	}
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		IDToken      string `json:"id_token"`
+		ExpiresIn    int    `json:"expires_in"`
+		Scope        string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(t.Scope)
+	// RFC 6749 lets the issuer leave out scope when it granted what we
+	// asked for
+	if t.Scope == "" {
+		scopes = p.config.Scopes
+	}
+	return &Token{
+		AccessToken:  t.AccessToken,
+		RefreshToken: t.RefreshToken,
+		IDToken:      t.IDToken,
+		ExpiresIn:    t.ExpiresIn,
+		Scopes:       scopes,
+	}, nil
+}
+
+// Revoke uses the RFC 7009 endpoint if the issuer has one, revoking the
+// refresh token ends the grant, the access token is revoked on its own in
+// case it outlives it.
+func (p *oidcProvider) Revoke(ctx context.Context, token *Token) error {
+	d, _, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if d.RevocationEndpoint == "" {
+		return errNoRevocation
+	}
+	tokens := []struct{ value, hint string }{
+		{token.RefreshToken, "refresh_token"},
+		{token.AccessToken, "access_token"},
+	}
+	for _, t := range tokens {
+		if t.value == "" {
+			continue
+		}
+		form := url.Values{}
+		form.Set("token", t.value)
+		form.Set("token_type_hint", t.hint)
+		form.Set("client_id", p.config.ClientID)
+		if p.config.ClientSecret != "" {
+			form.Set("client_secret", p.config.ClientSecret)
+		}
+		if err := postForm(ctx, p.client, p.config.Service, "token revocation", d.RevocationEndpoint, form); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *oidcProvider) Identity(ctx context.Context, token *Token, s *oauthState) (*Identity, error) {
+	d, keys, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("%s returned no id_token", p.config.Service)
+	}
+	claims, err := verifyIDToken(ctx, token.IDToken, keys, idTokenCheck{
+		Issuer:   d.Issuer,
+		Audience: p.config.ClientID,
+		Nonce:    s.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := []string{p.config.Claims.UserID, p.config.Claims.Name, p.config.Claims.DisplayName, p.config.Claims.Email}
+	for _, name := range mapped {
+		if _, ok := claims[name]; ok || d.UserinfoEndpoint == "" {
+			continue
+		}
+		// providers may keep profile claims out of the id_token
+		if err := p.userinfo(ctx, d.UserinfoEndpoint, token.AccessToken, claims); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	identity := &Identity{
+		Service:     p.config.Service,
+		UserID:      claimString(claims, p.config.Claims.UserID),
+		Name:        claimString(claims, p.config.Claims.Name),
+		DisplayName: claimString(claims, p.config.Claims.DisplayName),
+	}
+	if claimBool(claims, "email_verified") {
+		identity.Email = claimString(claims, p.config.Claims.Email)
+		identity.EmailVerified = identity.Email != ""
+	}
+	return identity, nil
+}
+
+// userinfo adds the claims of the userinfo endpoint that the id_token lacks.
+func (p *oidcProvider) userinfo(ctx context.Context, endpoint, accessToken string, claims jwt.MapClaims) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return providerError(p.config.Service, "userinfo", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(p.config.Service, "userinfo", resp); err != nil {
+		return err
+	}
+	info := map[string]interface{}{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return err
+	}
+	// userinfo has to describe the same user as the verified id_token
+	if sub, _ := info["sub"].(string); sub != claimString(claims, "sub") {
+		return fmt.Errorf("%s userinfo subject doesn't match the id_token", p.config.Service)
+	}
+	for k, v := range info {
+		if _, ok := claims[k]; !ok {
+			claims[k] = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOIDCScopes(t *testing.T) {
+	var granted *string
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                srv.URL,
+			AuthorizationEndpoint: srv.URL + "/authorize",
+			TokenEndpoint:         srv.URL + "/token",
+			JWKSURI:               srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		token := map[string]interface{}{"access_token": "access", "id_token": "id"}
+		if granted != nil {
+			token["scope"] = *granted
+		}
+		json.NewEncoder(w).Encode(token)
+	})
+
+	p, err := newOIDCProvider(OIDCConfig{
+		Service:     "example",
+		Issuer:      srv.URL,
+		ClientID:    "client",
+		RedirectURL: "https://unrustlelogs.example/example/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(p.Info().Scopes, " "); got != "openid profile email" {
+		t.Fatalf("provider requires scopes %q", got)
+	}
+
+	scope := func(s string) *string { return &s }
+	tests := []struct {
+		name    string
+		granted *string
+		err     string
+	}{
+		{name: "as requested", granted: scope("email openid profile")},
+		{name: "left out", granted: nil},
+		{name: "email refused", granted: scope("openid profile"), err: `scope "email" was requested but not granted`},
+		{name: "more than requested", granted: scope("openid profile email offline_access"), err: `scope "offline_access" was granted but not requested`},
+	}
+	for _, tt := range tests {
+		granted = tt.granted
+		token, err := p.Exchange(context.Background(), "code", &oauthState{Verifier: "verifier"})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		err = checkScopes(p.Info().Scopes, token.Scopes)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || err.Error() != tt.err):
+			t.Errorf("%s: error is %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// outboundTimeout bounds a whole call to a provider including retries
+	outboundTimeout = time.Second * 10
+	outboundRetries = 2
+	outboundBackoff = time.Millisecond * 250
+	// the breaker opens after this many failures in a row and lets a
+	// single request through after breakerCooldown
+	breakerThreshold = 5
+	breakerCooldown  = time.Second * 30
+)
+
+var errCircuitOpen = errors.New("too many recent failures, not trying again yet")
+
+// ProviderError is a failed call to an identity provider.
+type ProviderError struct {
+	Service string
+	// Op is what we tried, e.g. "token exchange"
+	Op string
+	// Status is the http status the provider answered with, 0 if none
+	Status int
+	Err    error
+}
+
+func (e *ProviderError) Error() string {
+	msg := fmt.Sprintf("%s %s failed", e.Service, e.Op)
+	if e.Status != 0 {
+		msg += fmt.Sprintf(" with %d", e.Status)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// Unavailable reports whether the provider is down rather than refusing us,
+// trying again later may help.
+func (e *ProviderError) Unavailable() bool {
+	if e.Status == http.StatusTooManyRequests || e.Status >= 500 {
+		return true
+	}
+	var ne net.Error
+	return errors.Is(e.Err, errCircuitOpen) || errors.As(e.Err, &ne)
+}
+
+// providerError wraps err unless it already is a ProviderError.
+func providerError(service, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	redactURL(err)
+	var pe *ProviderError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &ProviderError{Service: service, Op: op, Err: err}
+}
+
+// redactURL drops the query from the url of a failed request, codes and
+// tokens passed as parameters must not end up in the logs.
+func redactURL(err error) {
+	var ue *url.Error
+	if !errors.As(err, &ue) {
+		return
+	}
+	if u, perr := url.Parse(ue.URL); perr == nil && u.RawQuery != "" {
+		u.RawQuery = "redacted"
+		ue.URL = u.String()
+	}
+}
+
+// checkResponse turns anything but 200 into a ProviderError.
+func checkResponse(service, op string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &ProviderError{Service: service, Op: op, Status: resp.StatusCode}
+}
+
+// ErrorPayload ...
+type ErrorPayload struct {
+	Title     string
+	Message   string
+	RequestID string
+	// Back is where the button leads, Retry labels it as another attempt
+	Back  string
+	Retry bool
+}
+
+// errorPage renders a friendly error instead of a bare string.
+func (ur *UnRustleLogs) errorPage(c *gin.Context, status int, payload ErrorPayload) {
+	payload.RequestID = c.GetString("request_id")
+	c.HTML(status, "error.tmpl", payload)
+}
+
+// providerErrorPage logs err and tells the user whether waiting may help.
+func (ur *UnRustleLogs) providerErrorPage(c *gin.Context, info ProviderInfo, op string, err error) {
+	logrus.Error(err)
+	payload := ErrorPayload{
+		Title: info.Title + " login failed",
+		Back:  info.Path + "/login",
+		Retry: true,
+	}
+	var pe *ProviderError
+	if errors.As(err, &pe) && pe.Unavailable() {
+		payload.Message = info.Title + " isn't responding right now, please try again in a few minutes."
+		ur.errorPage(c, http.StatusServiceUnavailable, payload)
+		return
+	}
+	payload.Message = "We couldn't confirm your " + info.Title + " account (" + op + "), please log in again."
+	ur.errorPage(c, http.StatusBadGateway, payload)
+}
+
+// circuitBreaker stops calls to a provider that keeps failing.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether a call may be made.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < breakerThreshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < breakerCooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= breakerThreshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// resilientTransport retries idempotent requests with backoff and guards
+// the provider with a circuit breaker.
+type resilientTransport struct {
+	service string
+	base    http.RoundTripper
+	breaker *circuitBreaker
+	retries int
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// token exchanges use up the code, only requests without a body repeat
+	retries := 0
+	if req.Body == nil && (req.Method == "GET" || req.Method == "HEAD") {
+		retries = t.retries
+	}
+	for attempt := 0; ; attempt++ {
+		if !t.breaker.allow() {
+			return nil, errCircuitOpen
+		}
+		resp, err := t.base.RoundTrip(req)
+		failed := err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		t.breaker.record(!failed)
+		if !failed || attempt >= retries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+
+		// full jitter so retrying logins don't line up
+		wait := time.Duration(rand.Int63n(int64(outboundBackoff << uint(attempt))))
+		logrus.Warnf("%s %s failed, retrying in %s", t.service, req.URL.Path, wait)
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// postForm posts form to endpoint and checks the answer, op names the call
+// in errors.
+func postForm(ctx context.Context, client *http.Client, service, op, endpoint string, form url.Values) error {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return providerError(service, op, err)
+	}
+	resp.Body.Close()
+	return checkResponse(service, op, resp)
+}
+
+// newProviderClient returns the http client all calls to service go through.
+func newProviderClient(service string) *http.Client {
+	return &http.Client{
+		Timeout: outboundTimeout,
+		Transport: &resilientTransport{
+			service: service,
+			base:    http.DefaultTransport,
+			breaker: &circuitBreaker{},
+			retries: outboundRetries,
+		},
+	}
+}
+
+// withoutRetries returns a client sharing the breaker of client that never
+// repeats requests, for libraries that redeem codes with GET.
+func withoutRetries(client *http.Client) *http.Client {
+	t, ok := client.Transport.(*resilientTransport)
+	if !ok {
+		return client
+	}
+	once := *t
+	once.retries = 0
+	return &http.Client{Timeout: client.Timeout, Transport: &once}
+}
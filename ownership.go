@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tensei/unrustlelogs/redact"
+)
+
+// OwnershipWindow is a period in which a name belonged to a verified identity.
+// Lines of the name inside From..To are the requesters, lines in the review
+// periods around it might be and have to be checked by hand.
+type OwnershipWindow struct {
+	Name string
+	// zero From means the start is unknown
+	From time.Time
+	// zero To means the name is still owned
+	To time.Time
+	// Review are the periods around the window in which the rename happened
+	Review []redact.Window
+	// Services are the services the name was seen on
+	Services []string
+}
+
+// Period formats the window for humans.
+func (w OwnershipWindow) Period() string {
+	return formatPeriod(w.From, w.To)
+}
+
+// OwnershipConflict is something that prevents redacting a name
+// without a manual review.
+type OwnershipConflict struct {
+	Name   string
+	Reason string
+}
+
+// dggTimeLayouts are the formats destiny.gg has used for createdDate.
+var dggTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+}
+
+func parseDggTime(s string) *time.Time {
+	for _, layout := range dggTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			t = t.UTC()
+			return &t
+		}
+	}
+	return nil
+}
+
+// nameSpan is when we've seen an identity use a name.
+type nameSpan struct {
+	name      string
+	firstSeen time.Time
+	lastSeen  time.Time
+	services  []string
+}
+
+func (s *nameSpan) addService(service string) {
+	for _, v := range s.services {
+		if v == service {
+			return
+		}
+	}
+	s.services = append(s.services, service)
+}
+
+// nameSpans groups the name aliases case-insensitively, ordered by first seen.
+func nameSpans(aliases []IdentityAlias) []*nameSpan {
+	byName := map[string]*nameSpan{}
+	var spans []*nameSpan
+	for _, a := range aliases {
+		if a.Kind == AliasEmail {
+			continue
+		}
+		k := strings.ToLower(a.Value)
+		s, ok := byName[k]
+		if !ok {
+			s = &nameSpan{name: a.Value, firstSeen: a.FirstSeen, lastSeen: a.LastSeen}
+			s.addService(aliasService(a))
+			byName[k] = s
+			spans = append(spans, s)
+			continue
+		}
+		s.addService(aliasService(a))
+		if a.FirstSeen.Before(s.firstSeen) {
+			s.firstSeen = a.FirstSeen
+		}
+		if a.LastSeen.After(s.lastSeen) {
+			s.lastSeen = a.LastSeen
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].firstSeen.Before(spans[j].firstSeen)
+	})
+	return spans
+}
+
+// OwnershipWindows works out when the user owned each of their names from the
+// account creation date and the observed renames. Overlaps with other
+// identities that used the same names are returned as conflicts.
+func (ur *UnRustleLogs) OwnershipWindows(u *User) ([]OwnershipWindow, []OwnershipConflict) {
+	var conflicts []OwnershipConflict
+	spans := nameSpans(ur.Aliases(u.Service, u.UserID))
+	current := map[string]bool{}
+	for _, n := range []string{u.Name, u.DisplayName, u.Nick} {
+		current[strings.ToLower(n)] = true
+	}
+
+	windows := make([]OwnershipWindow, 0, len(spans))
+	for i, s := range spans {
+		w := OwnershipWindow{Name: s.name, Services: s.services}
+
+		// the first name we saw is assumed to be owned since the account was
+		// created, later names only since we first saw them
+		if i == 0 {
+			if u.AccountCreatedAt != nil {
+				w.From = *u.AccountCreatedAt
+			} else {
+				conflicts = append(conflicts, OwnershipConflict{s.name, "account creation date is unknown"})
+			}
+		} else {
+			w.From = s.firstSeen
+			before := lastSeenBefore(spans, s, s.firstSeen)
+			if before.IsZero() && u.AccountCreatedAt != nil {
+				before = *u.AccountCreatedAt
+			}
+			w.Review = append(w.Review, redact.Window{Nick: s.name, From: before, To: w.From, Services: s.services})
+		}
+
+		if !current[strings.ToLower(s.name)] {
+			w.To = s.lastSeen
+			after := firstSeenAfter(spans, s, s.lastSeen)
+			w.Review = append(w.Review, redact.Window{Nick: s.name, From: w.To, To: after, Services: s.services})
+		}
+		windows = append(windows, w)
+	}
+
+	for _, w := range windows {
+		conflicts = append(conflicts, ur.ownershipOverlaps(u, w)...)
+	}
+	return windows, conflicts
+}
+
+// lastSeenBefore returns the last time another name was seen before t.
+func lastSeenBefore(spans []*nameSpan, self *nameSpan, t time.Time) time.Time {
+	var last time.Time
+	for _, s := range spans {
+		if s != self && s.lastSeen.Before(t) && s.lastSeen.After(last) {
+			last = s.lastSeen
+		}
+	}
+	return last
+}
+
+// firstSeenAfter returns the first time another name was seen after t.
+func firstSeenAfter(spans []*nameSpan, self *nameSpan, t time.Time) time.Time {
+	var first time.Time
+	for _, s := range spans {
+		if s != self && s.firstSeen.After(t) && (first.IsZero() || s.firstSeen.Before(first)) {
+			first = s.firstSeen
+		}
+	}
+	return first
+}
+
+// ownershipOverlaps checks whether an identity outside the person was seen
+// with the name on one of the window's services while the window says it
+// belonged to u.
+func (ur *UnRustleLogs) ownershipOverlaps(u *User, w OwnershipWindow) []OwnershipConflict {
+	own := map[string]bool{}
+	for _, linked := range ur.LinkedUsers(u) {
+		own[linked.Service+":"+linked.UserID] = true
+	}
+	var conflicts []OwnershipConflict
+	seen := map[string]bool{}
+	for _, service := range w.Services {
+		var others []IdentityAlias
+		ur.db.Where("((service = ? and kind not like ?) or kind = ?) and kind <> ? and lower(value) = ?",
+			service, AliasChat+"%", AliasChat+service, AliasEmail, strings.ToLower(w.Name)).Find(&others)
+		for _, a := range others {
+			key := a.Service + ":" + a.UserID
+			if own[key] || seen[key] {
+				continue
+			}
+			if !overlaps(w.From, w.To, a.FirstSeen, a.LastSeen) {
+				continue
+			}
+			seen[key] = true
+			reason := fmt.Sprintf("%s account %s used this name between %s and %s",
+				a.Service, a.UserID, a.FirstSeen.Format("2006-01-02"), a.LastSeen.Format("2006-01-02"))
+			if a.Service != service {
+				reason = fmt.Sprintf("%s account %s proved this name in %s chat between %s and %s",
+					a.Service, a.UserID, service, a.FirstSeen.Format("2006-01-02"), a.LastSeen.Format("2006-01-02"))
+			}
+			conflicts = append(conflicts, OwnershipConflict{Name: w.Name, Reason: reason})
+		}
+	}
+	return conflicts
+}
+
+// overlaps reports whether two periods overlap, zero times are open ends.
+func overlaps(aFrom, aTo, bFrom, bTo time.Time) bool {
+	if !aTo.IsZero() && !bFrom.IsZero() && aTo.Before(bFrom) {
+		return false
+	}
+	if !bTo.IsZero() && !aFrom.IsZero() && bTo.Before(aFrom) {
+		return false
+	}
+	return true
+}
+
+// formatPeriod formats a period with open ends for humans.
+func formatPeriod(from, to time.Time) string {
+	f, t := "unknown", "now"
+	if !from.IsZero() {
+		f = from.Format("2006-01-02 15:04")
+	}
+	if !to.IsZero() {
+		t = to.Format("2006-01-02 15:04")
+	}
+	return f + " - " + t
+}
+
+// redactWindows flattens ownership windows into the windows used by the
+// redaction, each only covers the chats of the services the name was seen
+// on.
+func redactWindows(windows []OwnershipWindow) (owned, review []redact.Window) {
+	for _, w := range windows {
+		owned = append(owned, redact.Window{Nick: w.Name, From: w.From, To: w.To, Services: w.Services})
+		review = append(review, w.Review...)
+	}
+	return owned, review
+}
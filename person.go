@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// Person groups the provider identities of one human, every user belongs to
+// exactly one person and requests cover all of them.
+type Person struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+}
+
+var errLinkOpenRequests = errors.New("both accounts have a request in progress, withdraw one of them first")
+
+func createPerson(tx *gorm.DB) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	p := &Person{ID: id.String()}
+	return p.ID, tx.Create(p).Error
+}
+
+// backfillPersons gives every user from before account linking its own person.
+func (ur *UnRustleLogs) backfillPersons() error {
+	var users []User
+	if err := ur.db.Where("person_id is null or person_id = ''").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		err := ur.transaction(func(tx *gorm.DB) error {
+			id, err := createPerson(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Model(&User{}).Where("id = ?", u.ID).Update("person_id", id).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(users) > 0 {
+		logrus.Infof("created persons for %d users", len(users))
+	}
+	return nil
+}
+
+// LinkedUsers returns every user of the person u belongs to, oldest first.
+func (ur *UnRustleLogs) LinkedUsers(u *User) []*User {
+	if u.PersonID == "" {
+		return []*User{u}
+	}
+	var users []*User
+	ur.db.Where("person_id = ?", u.PersonID).Order("created_at asc").Find(&users)
+	if len(users) == 0 {
+		return []*User{u}
+	}
+	return users
+}
+
+// linkedUserIDs returns the ids of every user linked to the user with id.
+func (ur *UnRustleLogs) linkedUserIDs(id string) []string {
+	u, ok := ur.GetUser(id)
+	if !ok {
+		return []string{id}
+	}
+	users := ur.LinkedUsers(u)
+	ids := make([]string, len(users))
+	for i, linked := range users {
+		ids[i] = linked.ID
+	}
+	return ids
+}
+
+// LinkUsers moves every identity of the person of otherID to the person of
+// userID. Two open requests can't be merged, one has to be withdrawn first.
+func (ur *UnRustleLogs) LinkUsers(actor Actor, userID, otherID string) error {
+	return ur.auditTransaction(func(tx *gorm.DB) error {
+		var u, other User
+		if err := tx.Where("id = ?", userID).First(&u).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("id = ?", otherID).First(&other).Error; err != nil {
+			return err
+		}
+		if u.PersonID == other.PersonID {
+			return nil
+		}
+
+		open := 0
+		for _, personID := range []string{u.PersonID, other.PersonID} {
+			var count int
+			err := tx.Table("deletion_requests").
+				Joins("join users on users.id = deletion_requests.user_id").
+				Where("users.person_id = ? and deletion_requests.status in (?)", personID, openStatuses()).
+				Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				open++
+			}
+		}
+		if open > 1 {
+			return errLinkOpenRequests
+		}
+
+		moved := tx.Model(&User{}).Where("person_id = ?", other.PersonID).Update("person_id", u.PersonID)
+		if moved.Error != nil {
+			return moved.Error
+		}
+		if err := tx.Where("id = ?", other.PersonID).Delete(&Person{}).Error; err != nil {
+			return err
+		}
+		details := fmt.Sprintf("user:%s joined with %d users of person:%s", u.ID, moved.RowsAffected, other.PersonID)
+		return ur.appendAudit(tx, actor, AuditIdentityLink, "person:"+u.PersonID, details)
+	})
+}
+
+// PersonWindows returns the name ownership windows of every identity linked
+// to u, redacting a request covers all of them.
+func (ur *UnRustleLogs) PersonWindows(u *User) ([]OwnershipWindow, []OwnershipConflict) {
+	var windows []OwnershipWindow
+	var conflicts []OwnershipConflict
+	for _, linked := range ur.LinkedUsers(u) {
+		w, c := ur.OwnershipWindows(linked)
+		windows = append(windows, w...)
+		conflicts = append(conflicts, c...)
+	}
+	return windows, conflicts
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// policy signals
+const (
+	SignalEmailVerified  = "email_verified"
+	SignalEmailConfirmed = "email_confirmed"
+	SignalAccountAge     = "account_age"
+	SignalAccountStatus  = "account_status"
+	SignalLinkedAccounts = "linked_accounts"
+	SignalTrustedRole    = "trusted_role"
+	SignalChatProof      = "chat_proof"
+)
+
+// policyActor approves requests the policy is confident about.
+var policyActor = Actor{Name: "policy", RequestID: "policy"}
+
+// PolicyConfig decides which requests are approved without staff.
+type PolicyConfig struct {
+	// AutoApprove is the score a request needs, 0 disables auto approval
+	AutoApprove       int      `toml:"auto_approve"`
+	MinAccountAgeDays int      `toml:"min_account_age_days"`
+	ActiveStatuses    []string `toml:"active_statuses"`
+	TrustedRoles      []string `toml:"trusted_roles"`
+	// Weights are the points of each signal, missing ones use the defaults
+	Weights map[string]int
+}
+
+var defaultPolicyWeights = map[string]int{
+	SignalEmailVerified:  2,
+	SignalEmailConfirmed: 3,
+	SignalAccountAge:     2,
+	SignalAccountStatus:  1,
+	SignalLinkedAccounts: 2,
+	SignalTrustedRole:    1,
+	SignalChatProof:      3,
+}
+
+// PolicySignal is one thing the policy looked at.
+type PolicySignal struct {
+	Name   string
+	Points int
+	Passed bool
+	Reason string
+}
+
+// PolicyDecision is the outcome of the policy for a request.
+type PolicyDecision struct {
+	Score       int
+	Threshold   int
+	AutoApprove bool
+	Signals     []PolicySignal
+	// Blockers force manual review regardless of the score
+	Blockers []string
+}
+
+// Summary is the one line reasoning stored with an auto approval.
+func (d PolicyDecision) Summary() string {
+	var passed []string
+	for _, s := range d.Signals {
+		if s.Passed {
+			passed = append(passed, s.Name)
+		}
+	}
+	return fmt.Sprintf("score %d/%d (%s)", d.Score, d.Threshold, strings.Join(passed, ", "))
+}
+
+func (ur *UnRustleLogs) policyWeight(signal string) int {
+	if w, ok := ur.config.Policy.Weights[signal]; ok {
+		return w
+	}
+	return defaultPolicyWeights[signal]
+}
+
+// EvaluatePolicy scores the identities behind a request. Every signal counts
+// once, it passes if any linked identity satisfies it.
+func (ur *UnRustleLogs) EvaluatePolicy(r *DeletionRequest) PolicyDecision {
+	policy := ur.config.Policy
+	d := PolicyDecision{Threshold: policy.AutoApprove}
+	user, ok := ur.GetUser(r.UserID)
+	if !ok {
+		d.Blockers = append(d.Blockers, "the requesting user no longer exists")
+		return d
+	}
+	linked := ur.LinkedUsers(user)
+
+	add := func(name string, passed bool, reason string) {
+		s := PolicySignal{Name: name, Points: ur.policyWeight(name), Passed: passed, Reason: reason}
+		if passed {
+			d.Score += s.Points
+		}
+		d.Signals = append(d.Signals, s)
+	}
+
+	var verified []string
+	for _, u := range linked {
+		if u.EmailVerified && u.Email != "" {
+			verified = append(verified, u.Service)
+		}
+	}
+	if len(verified) > 0 {
+		add(SignalEmailVerified, true, "email verified by "+strings.Join(verified, ", "))
+	} else {
+		add(SignalEmailVerified, false, "no provider vouched for an email")
+	}
+
+	if r.EmailVerifiedAt != nil {
+		add(SignalEmailConfirmed, true, "confirmed on "+r.EmailVerifiedAt.Format("2006-01-02"))
+	} else {
+		add(SignalEmailConfirmed, false, "email confirmation not completed")
+	}
+
+	if ch, ok := ur.VerifiedChatChallenge(r.ID); ok {
+		title, _ := ur.chatTitle(ch.Chat)
+		add(SignalChatProof, true, "posted the challenge code in "+title+" as "+ch.Name)
+	} else {
+		add(SignalChatProof, false, "no chat proof")
+	}
+
+	var oldest *time.Time
+	for _, u := range linked {
+		if u.AccountCreatedAt != nil && (oldest == nil || u.AccountCreatedAt.Before(*oldest)) {
+			oldest = u.AccountCreatedAt
+		}
+	}
+	minAge := time.Duration(policy.MinAccountAgeDays) * time.Hour * 24
+	switch {
+	case oldest == nil:
+		add(SignalAccountAge, false, "account age unknown")
+	case time.Since(*oldest) < minAge:
+		add(SignalAccountAge, false, fmt.Sprintf("oldest account created %s, less than %d days ago", oldest.Format("2006-01-02"), policy.MinAccountAgeDays))
+	default:
+		add(SignalAccountAge, true, "oldest account created "+oldest.Format("2006-01-02"))
+	}
+
+	// providers that don't report a status can't fail this
+	var statuses []string
+	active := false
+	for _, u := range linked {
+		if u.AccountStatus == "" {
+			continue
+		}
+		statuses = append(statuses, u.Service+": "+u.AccountStatus)
+		if containsFold(policy.ActiveStatuses, u.AccountStatus) {
+			active = true
+		}
+	}
+	switch {
+	case len(statuses) == 0:
+		add(SignalAccountStatus, false, "no provider reports an account status")
+	case active:
+		add(SignalAccountStatus, true, strings.Join(statuses, ", "))
+	default:
+		add(SignalAccountStatus, false, "no active account ("+strings.Join(statuses, ", ")+")")
+	}
+
+	if len(linked) > 1 {
+		add(SignalLinkedAccounts, true, fmt.Sprintf("%d linked identities", len(linked)))
+	} else {
+		add(SignalLinkedAccounts, false, "single identity")
+	}
+
+	var trusted []string
+	for _, u := range linked {
+		for _, role := range splitList(u.Roles + "," + u.Features) {
+			if containsFold(policy.TrustedRoles, role) {
+				trusted = append(trusted, u.Service+": "+role)
+			}
+		}
+	}
+	if len(trusted) > 0 {
+		add(SignalTrustedRole, true, strings.Join(trusted, ", "))
+	} else {
+		add(SignalTrustedRole, false, "no trusted role")
+	}
+
+	if _, conflicts := ur.PersonWindows(user); len(conflicts) > 0 {
+		d.Blockers = append(d.Blockers, fmt.Sprintf("%d name ownership conflicts", len(conflicts)))
+	}
+	flags, err := ur.FraudFlags(r)
+	if err != nil {
+		logrus.Error(err)
+		d.Blockers = append(d.Blockers, "fraud checks failed")
+	}
+	for _, f := range flags {
+		d.Blockers = append(d.Blockers, "flagged "+f.Name+": "+f.Reason)
+	}
+	if policy.AutoApprove <= 0 {
+		d.Blockers = append(d.Blockers, "auto approval is disabled")
+	}
+	d.AutoApprove = len(d.Blockers) == 0 && d.Score >= policy.AutoApprove
+	return d
+}
+
+// autoApprove approves a verified request if the policy allows it.
+func (ur *UnRustleLogs) autoApprove(r *DeletionRequest) (*DeletionRequest, bool) {
+	if r.Status != StatusIdentityVerified || ur.config.Policy.AutoApprove <= 0 {
+		return r, false
+	}
+	d := ur.EvaluatePolicy(r)
+	if !d.AutoApprove {
+		return r, false
+	}
+	approved, err := ur.TransitionRequest(r.ID, StatusApproved, policyActor, "auto approved: "+d.Summary())
+	if err != nil {
+		logrus.Error(err)
+		return r, false
+	}
+	return approved, true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma separated column, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
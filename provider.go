@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// how long a login may take between redirect and callback
+const oauthStateTTL = time.Minute * 5
+
+// oauthErrors explain the error codes of RFC 6749 and OpenID Connect a
+// provider sends back to the callback, other values aren't shown.
+var oauthErrors = map[string]string{
+	"access_denied":             "you didn't allow the login",
+	"invalid_scope":             "it doesn't grant the permissions we asked for",
+	"login_required":            "you have to log in there first",
+	"consent_required":          "you didn't allow the login",
+	"interaction_required":      "you have to confirm the login there first",
+	"server_error":              "it had an internal error",
+	"temporarily_unavailable":   "it is temporarily unavailable",
+	"invalid_request":           "it rejected our login request",
+	"unauthorized_client":       "it rejected our login request",
+	"unsupported_response_type": "it rejected our login request",
+}
+
+// stateCookie holds the state of the login the browser started with the
+// provider, a callback only counts in the browser that started it.
+func stateCookie(service string) string {
+	return "oauth_" + service
+}
+
+// ProviderInfo describes a provider for routes and templates.
+type ProviderInfo struct {
+	// Service is stored on users and used in the staff config
+	Service string
+	// Path is the route group of the provider, e.g. "/twitch"
+	Path  string
+	Title string
+	// Icon is a font awesome class, empty for none
+	Icon   string
+	Cookie string
+	// Scopes have to be granted exactly, empty if the provider has none
+	Scopes []string
+}
+
+// Token is the result of an authorization code exchange. Tokens are only
+// kept until the identity is known and never stored or logged.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	IDToken      string
+	ExpiresIn    int
+	Scopes       []string
+}
+
+// String keeps tokens out of logs and error messages.
+func (t Token) String() string {
+	return fmt.Sprintf("token(scopes=%s)", strings.Join(t.Scopes, " "))
+}
+
+// GoString is used by %#v.
+func (t Token) GoString() string {
+	return t.String()
+}
+
+// errNoRevocation is returned by providers without a revocation endpoint.
+var errNoRevocation = errors.New("provider offers no token revocation")
+
+// tokenRevoker is implemented by providers that can revoke tokens, revoking
+// has to invalidate the refresh token too.
+type tokenRevoker interface {
+	Revoke(ctx context.Context, token *Token) error
+}
+
+// Identity is a provider account normalized to what we store on User.
+type Identity struct {
+	Service     string
+	UserID      string
+	Name        string
+	DisplayName string
+	Nick        string
+	Email       string
+	// EmailVerified is set if the provider vouches for the email
+	EmailVerified bool
+	// CreatedAt is when the account was created at the provider, if known
+	CreatedAt *time.Time
+	// Status, Roles and Features are whatever the provider reports
+	Status   string
+	Roles    []string
+	Features []string
+}
+
+// Provider is an OAuth identity provider users can log in with.
+type Provider interface {
+	Info() ProviderInfo
+	// AuthorizationURL returns where to send the user, anything needed
+	// in the callback is stored on s.
+	AuthorizationURL(state string, s *oauthState) (string, error)
+	Exchange(ctx context.Context, code string, s *oauthState) (*Token, error)
+	Identity(ctx context.Context, token *Token, s *oauthState) (*Identity, error)
+}
+
+// oauthState is remembered between the login redirect and the callback.
+type oauthState struct {
+	Service  string
+	Verifier string
+	Nonce    string
+	Created  time.Time
+	// LinkUser is the user the new identity gets linked to, if any
+	LinkUser string
+}
+
+// setupProviders registers every provider that is configured.
+func (ur *UnRustleLogs) setupProviders() error {
+	ur.providers = nil
+	if ur.config.Twitch.ClientID != "" {
+		p, err := newTwitchProvider(ur.config)
+		if err != nil {
+			return err
+		}
+		ur.providers = append(ur.providers, p)
+	}
+	if ur.config.Destinygg.ClientID != "" {
+		p, err := newDestinyggProvider(ur.config)
+		if err != nil {
+			return err
+		}
+		ur.providers = append(ur.providers, p)
+	}
+	if ur.config.Discord.ClientID != "" {
+		p, err := newDiscordProvider(ur.config)
+		if err != nil {
+			return err
+		}
+		ur.providers = append(ur.providers, p)
+	}
+	for _, c := range ur.config.OIDC {
+		p, err := newOIDCProvider(c)
+		if err != nil {
+			return err
+		}
+		ur.providers = append(ur.providers, p)
+	}
+	if len(ur.providers) == 0 {
+		return fmt.Errorf("no identity provider is configured")
+	}
+
+	seen := map[string]bool{}
+	for _, path := range reservedPaths {
+		seen["path "+path] = true
+	}
+	for _, p := range ur.providers {
+		info := p.Info()
+		keys := []string{"service " + info.Service, "path " + info.Path, "cookie " + info.Cookie}
+		for _, k := range keys {
+			if seen[k] {
+				return fmt.Errorf("provider %s uses the %s of another provider or route", info.Service, k)
+			}
+		}
+		for _, k := range keys {
+			seen[k] = true
+		}
+	}
+	return nil
+}
+
+// reservedPaths can't be used by providers.
+var reservedPaths = []string{"/", "/admin", "/assets", "/email", "/status", "/verify", "/robots.txt"}
+
+// providerInfos returns the info of every registered provider in order.
+func (ur *UnRustleLogs) providerInfos() []ProviderInfo {
+	infos := make([]ProviderInfo, len(ur.providers))
+	for i, p := range ur.providers {
+		infos[i] = p.Info()
+	}
+	return infos
+}
+
+// providerByService returns the provider of service.
+func (ur *UnRustleLogs) providerByService(service string) (Provider, bool) {
+	for _, p := range ur.providers {
+		if p.Info().Service == service {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// providerServices returns the service of every provider.
+func (ur *UnRustleLogs) providerServices() []string {
+	services := make([]string, len(ur.providers))
+	for i, p := range ur.providers {
+		services[i] = p.Info().Service
+	}
+	return services
+}
+
+// providerCookies returns the login cookie of every provider.
+func (ur *UnRustleLogs) providerCookies() []string {
+	cookies := make([]string, len(ur.providers))
+	for i, p := range ur.providers {
+		cookies[i] = p.Info().Cookie
+	}
+	return cookies
+}
+
+// registerProvider adds the routes of a provider to the router.
+func (ur *UnRustleLogs) registerProvider(router gin.IRouter, p Provider) {
+	info := p.Info()
+	g := router.Group(info.Path)
+	g.GET("/", ur.providerIndexHandle(p))
+	login := ur.rateLimit(limitLogin, "")
+	g.GET("/login", login, ur.loginHandle(p))
+	g.POST("/link", login, ur.linkHandle(p))
+	g.POST("/logout", ur.logoutHandle(p))
+	g.POST("/logout/all", ur.logoutAllHandle(info.Cookie, info.Path))
+	g.GET("/callback", login, ur.callbackHandle(p))
+	actions := ur.rateLimit(limitActions, info.Cookie)
+	g.POST("/request", actions, ur.submitRequestHandle(info.Cookie, info.Path))
+	g.POST("/email", ur.rateLimit(limitEmail, info.Cookie), ur.sendEmailVerificationHandle(info.Cookie, info.Path))
+	g.POST("/challenge", actions, ur.chatChallengeHandle(info.Cookie, info.Path))
+	g.POST("/withdraw", actions, ur.withdrawRequestHandle(info.Cookie, info.Path))
+	g.POST("/forget", actions, ur.forgetUserHandle(info.Cookie, info.Path))
+}
+
+// takeState returns and removes the state, every state can only be used once.
+func (ur *UnRustleLogs) takeState(key string) (*oauthState, bool) {
+	if strings.TrimSpace(key) == "" {
+		return nil, false
+	}
+	s, ok, err := ur.states.Take(key)
+	if err != nil {
+		logrus.Error(err)
+		return nil, false
+	}
+	return s, ok
+}
+
+// ProviderPayload ...
+type ProviderPayload struct {
+	Provider  ProviderInfo
+	EmailSent bool
+	Forgotten bool
+	LoggedIn  bool
+	ID        string
+	Name      string
+	Email     string
+	Request   *DeletionRequest
+	// Linked are the other identities of the person
+	Linked []*User
+	// Others are the providers that can be linked
+	Others []ProviderInfo
+	// Chats can prove the identity instead of an email
+	Chats          []ChatInfo
+	Challenge      *ChatChallenge
+	ChallengeError string
+	// Sessions are the active logins of the person, Session is this one
+	Sessions []Session
+	Session  string
+	CSRF     string
+}
+
+func (ur *UnRustleLogs) providerIndexHandle(p Provider) gin.HandlerFunc {
+	info := p.Info()
+	return func(c *gin.Context) {
+		payload := ProviderPayload{
+			Provider:  info,
+			EmailSent: c.Query("email") == "sent",
+			Forgotten: c.Query("forgotten") != "",
+			Chats:     ur.chats(),
+			CSRF:      csrfToken(c),
+			// codes only, the query string is anyone's to write
+			ChallengeError: challengeErrors[c.Query("challenge")],
+		}
+		if session, user, ok := ur.currentSession(c, info.Cookie); ok {
+			payload.Session = session.ID
+			payload.Sessions = ur.UserSessions(user)
+			payload.Name = user.DisplayName
+			payload.Email = user.Email
+			payload.LoggedIn = true
+			payload.ID = user.ID
+			if r, ok := ur.LatestDeletionRequest(user.ID); ok {
+				payload.Request = r
+				if ch, ok := ur.PendingChatChallenge(r.ID); ok {
+					payload.Challenge = ch
+				}
+			}
+			for _, linked := range ur.LinkedUsers(user) {
+				if linked.ID != user.ID {
+					payload.Linked = append(payload.Linked, linked)
+				}
+			}
+			for _, other := range ur.providerInfos() {
+				if other.Service != info.Service {
+					payload.Others = append(payload.Others, other)
+				}
+			}
+		}
+		c.HTML(http.StatusOK, "provider.tmpl", payload)
+	}
+}
+
+func (ur *UnRustleLogs) loginHandle(p Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ur.startLogin(c, p, "")
+	}
+}
+
+// linkHandle logs in with p and links the identity to the user that is
+// logged in with the provider given by the from field.
+func (ur *UnRustleLogs) linkHandle(p Provider) gin.HandlerFunc {
+	info := p.Info()
+	return func(c *gin.Context) {
+		from, ok := ur.providerByService(c.PostForm("from"))
+		if !ok {
+			c.Redirect(http.StatusFound, info.Path)
+			return
+		}
+		user, ok := ur.getUserFromJWT(c, from.Info().Cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, from.Info().Path)
+			return
+		}
+		ur.startLogin(c, p, user.ID)
+	}
+}
+
+// startLogin sends the user to the provider.
+func (ur *UnRustleLogs) startLogin(c *gin.Context, p Provider, linkUser string) {
+	info := p.Info()
+	key := uniuri.NewLen(60)
+	s := &oauthState{Service: info.Service, Created: time.Now().UTC(), LinkUser: linkUser}
+	url, err := p.AuthorizationURL(key, s)
+	if err != nil {
+		ur.providerErrorPage(c, info, "login", providerError(info.Service, "login", err))
+		return
+	}
+	if err := ur.states.Put(key, s, oauthStateTTL); err != nil {
+		if err != errStateStoreFull {
+			logrus.Error(err)
+		}
+		ur.errorPage(c, http.StatusServiceUnavailable, ErrorPayload{
+			Title:   info.Title + " login failed",
+			Message: "Too many logins are in progress right now, please try again in a few minutes.",
+			Back:    info.Path + "/login",
+			Retry:   true,
+		})
+		return
+	}
+	// lax, the provider sends the browser back with a top level redirect
+	setCookie(c, stateCookie(info.Service), key, int(oauthStateTTL/time.Second), http.SameSiteLaxMode)
+
+	c.Header("Location", url)
+	c.Redirect(http.StatusFound, url)
+}
+
+func (ur *UnRustleLogs) logoutHandle(p Provider) gin.HandlerFunc {
+	info := p.Info()
+	return func(c *gin.Context) {
+		if s, _, err := ur.cookieSession(c, info.Cookie); err == nil {
+			if err := ur.EndSession(s.ID); err != nil {
+				logrus.Error(err)
+			}
+		}
+		ur.deleteCookie(c, info.Cookie)
+		c.Redirect(http.StatusFound, "/")
+	}
+}
+
+func (ur *UnRustleLogs) callbackHandle(p Provider) gin.HandlerFunc {
+	info := p.Info()
+	return func(c *gin.Context) {
+		key := c.Query("state")
+		started, _ := c.Cookie(stateCookie(info.Service))
+		ur.deleteCookie(c, stateCookie(info.Service))
+		// someone else's login must not finish in this browser
+		if key == "" || subtle.ConstantTimeCompare([]byte(started), []byte(key)) != 1 {
+			ur.errorPage(c, http.StatusBadRequest, ErrorPayload{
+				Title:   info.Title + " login failed",
+				Message: "This login wasn't started in this browser or took too long, please try again.",
+				Back:    info.Path + "/login",
+				Retry:   true,
+			})
+			return
+		}
+		s, ok := ur.takeState(key)
+		if !ok || s.Service != info.Service {
+			c.Redirect(http.StatusFound, "/")
+			return
+		}
+		// only the user who asked for the link may finish it
+		if s.LinkUser != "" && !ur.loggedInAs(c, s.LinkUser) {
+			ur.errorPage(c, http.StatusForbidden, ErrorPayload{
+				Title:   "Couldn't link the accounts",
+				Message: "You have to stay logged in with the account you are linking to, please log in and try again.",
+				Back:    info.Path,
+			})
+			return
+		}
+		if code := c.Query("error"); code != "" {
+			reason, ok := oauthErrors[code]
+			if !ok {
+				reason = "it returned an error"
+			}
+			ur.errorPage(c, http.StatusBadRequest, ErrorPayload{
+				Title:   info.Title + " login cancelled",
+				Message: info.Title + " didn't log you in, " + reason + ".",
+				Back:    info.Path + "/login",
+				Retry:   true,
+			})
+			return
+		}
+		code := c.Query("code")
+		if code == "" {
+			ur.providerErrorPage(c, info, "login", &ProviderError{Service: info.Service, Op: "login", Err: errors.New("callback without code")})
+			return
+		}
+
+		ctx := c.Request.Context()
+		token, err := p.Exchange(ctx, code, s)
+		if err != nil {
+			ur.providerErrorPage(c, info, "token exchange", providerError(info.Service, "token exchange", err))
+			return
+		}
+		// we only need the identity, the token is revoked right after
+		var identity *Identity
+		scopeErr := checkScopes(info.Scopes, token.Scopes)
+		if scopeErr == nil {
+			identity, err = p.Identity(ctx, token, s)
+			if err == nil && identity.UserID == "" {
+				err = errors.New("user without id")
+			}
+		}
+		revocation := ur.revokeToken(ctx, p, token)
+		if scopeErr != nil || err != nil {
+			ur.audit(ur.actor(c, "provider:"+info.Service), AuditTokenRevoke, "provider:"+info.Service, revocation)
+		}
+		if scopeErr != nil {
+			logrus.Errorf("%s: %v", info.Service, scopeErr)
+			ur.errorPage(c, http.StatusForbidden, ErrorPayload{
+				Title:   info.Title + " login failed",
+				Message: "The permissions you granted don't match what we asked for, please log in again without changing them.",
+				Back:    info.Path + "/login",
+				Retry:   true,
+			})
+			return
+		}
+		if err != nil {
+			ur.providerErrorPage(c, info, "user lookup", providerError(info.Service, "user lookup", err))
+			return
+		}
+
+		id := ur.AddUser(identity)
+		if id == "" {
+			ur.errorPage(c, http.StatusInternalServerError, ErrorPayload{
+				Title:   "Something went wrong",
+				Message: "We couldn't save your login, please try again later.",
+				Back:    info.Path,
+			})
+			return
+		}
+		ur.audit(ur.actor(c, "user:"+id), AuditLogin, "user:"+id, "")
+		ur.audit(ur.actor(c, "user:"+id), AuditTokenRevoke, "user:"+id, revocation)
+		if err := ur.setLoginCookie(c, info.Cookie, id); err != nil {
+			logrus.Error(err)
+			ur.errorPage(c, http.StatusInternalServerError, ErrorPayload{
+				Title:   "Something went wrong",
+				Message: "We couldn't log you in, please try again later.",
+				Back:    info.Path,
+			})
+			return
+		}
+		if s.LinkUser != "" && s.LinkUser != id {
+			if err := ur.LinkUsers(ur.actor(c, "user:"+s.LinkUser), s.LinkUser, id); err != nil {
+				payload := ErrorPayload{
+					Title:   "Couldn't link the accounts",
+					Message: "Something went wrong while linking your accounts, please try again later.",
+					Back:    info.Path,
+				}
+				if err == errLinkOpenRequests {
+					payload.Message = "Both accounts have a request in progress, withdraw one of them first."
+				} else {
+					logrus.Error(err)
+				}
+				ur.errorPage(c, http.StatusConflict, payload)
+				return
+			}
+		}
+		c.Redirect(http.StatusFound, info.Path)
+	}
+}
+
+// checkScopes reports an error unless granted are exactly the requested
+// scopes, more would be access we never asked for.
+func checkScopes(requested, granted []string) error {
+	if len(requested) == 0 {
+		return nil
+	}
+	want := map[string]bool{}
+	for _, s := range requested {
+		want[s] = true
+	}
+	got := map[string]bool{}
+	for _, s := range granted {
+		got[s] = true
+	}
+	for s := range got {
+		if !want[s] {
+			return fmt.Errorf("scope %q was granted but not requested", s)
+		}
+	}
+	for s := range want {
+		if !got[s] {
+			return fmt.Errorf("scope %q was requested but not granted", s)
+		}
+	}
+	return nil
+}
+
+// revokeToken revokes the token at the provider and forgets it, the outcome
+// is returned for the audit log.
+func (ur *UnRustleLogs) revokeToken(ctx context.Context, p Provider, token *Token) string {
+	defer func() {
+		*token = Token{Scopes: token.Scopes}
+	}()
+	r, ok := p.(tokenRevoker)
+	if !ok {
+		return "token discarded, " + errNoRevocation.Error()
+	}
+	err := r.Revoke(ctx, token)
+	switch {
+	case err == errNoRevocation:
+		return "token discarded, " + err.Error()
+	case err != nil:
+		err = providerError(p.Info().Service, "token revocation", err)
+		logrus.Error(err)
+		return "token discarded, revocation failed: " + err.Error()
+	}
+	return "token revoked"
+}
+
+// setLoginCookie starts a session for the user and stores its token in
+// cookie, the session the cookie held before ends.
+func (ur *UnRustleLogs) setLoginCookie(c *gin.Context, cookie, id string) error {
+	user, ok := ur.GetUser(id)
+	if !ok {
+		return fmt.Errorf("user %s not found", id)
+	}
+	if old, _, err := ur.cookieSession(c, cookie); err == nil {
+		if err := ur.EndSession(old.ID); err != nil {
+			return err
+		}
+	}
+	s, err := ur.CreateSession(c, user)
+	if err != nil {
+		return err
+	}
+	return ur.writeSessionCookie(c, cookie, s)
+}
+
+func (ur *UnRustleLogs) deleteCookie(c *gin.Context, cookie string) {
+	setCookie(c, cookie, "", -1, http.SameSiteLaxMode)
+}
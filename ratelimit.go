@@ -0,0 +1,414 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMaxBuckets bounds the memory limiter, see memoryRateLimiter
+	defaultMaxBuckets = 100000
+	// bucketJanitorInterval is how often full buckets are dropped
+	bucketJanitorInterval = time.Minute
+)
+
+// route groups with their own limits
+const (
+	limitLogin   = "login"
+	limitVerify  = "verify"
+	limitEmail   = "email"
+	limitActions = "actions"
+)
+
+// rateLimitMetrics count limited requests per group, evicted buckets and
+// limiter errors, see /admin/debug/vars.
+var rateLimitMetrics = expvar.NewMap("rate_limits")
+
+// RateLimit lets a key make burst requests at once and per_minute after
+// that. A negative per_minute turns the limit off.
+type RateLimit struct {
+	PerMinute int `toml:"per_minute"`
+	Burst     int
+}
+
+// RateLimitConfig limits requests per route group, missing limits use the
+// defaults from withDefaults.
+type RateLimitConfig struct {
+	// Backend is "memory" or "sqlite" to share the limits between
+	// instances, see rateLimit for when the database fails
+	Backend string
+	// Login covers the login, link and callback pages
+	Login RateLimit
+	// Verify covers /verify and /status
+	Verify RateLimit
+	// Email covers sending and confirming verification mails
+	Email RateLimit
+	// Actions covers the forms of logged in users
+	Actions RateLimit
+}
+
+func (c RateLimitConfig) withDefaults() RateLimitConfig {
+	def := func(l *RateLimit, perMinute, burst int) {
+		if l.PerMinute == 0 {
+			l.PerMinute = perMinute
+		}
+		if l.Burst <= 0 {
+			l.Burst = burst
+		}
+	}
+	def(&c.Login, 10, 20)
+	def(&c.Verify, 20, 20)
+	def(&c.Email, 2, 5)
+	def(&c.Actions, 20, 20)
+	return c
+}
+
+func (c RateLimitConfig) limit(group string) RateLimit {
+	c = c.withDefaults()
+	switch group {
+	case limitLogin:
+		return c.Login
+	case limitVerify:
+		return c.Verify
+	case limitEmail:
+		return c.Email
+	default:
+		return c.Actions
+	}
+}
+
+// RateLimiter keeps a token bucket per key.
+type RateLimiter interface {
+	// Allow takes a token from the bucket of key, without one wait is how
+	// long until the next arrives. An error means the limit couldn't be
+	// checked.
+	Allow(key string, limit RateLimit) (ok bool, wait time.Duration, err error)
+	Close() error
+}
+
+// takeToken refills a bucket holding tokens since updated and takes one
+// from it, full is when the bucket has refilled completely.
+func takeToken(tokens float64, updated, now time.Time, limit RateLimit) (left float64, ok bool, wait time.Duration, full time.Time) {
+	perSecond := float64(limit.PerMinute) / 60
+	burst := float64(limit.Burst)
+	tokens = math.Min(burst, tokens+now.Sub(updated).Seconds()*perSecond)
+	if tokens >= 1 {
+		tokens--
+		ok = true
+	} else {
+		wait = time.Duration((1 - tokens) / perSecond * float64(time.Second))
+	}
+	full = now.Add(time.Duration((burst - tokens) / perSecond * float64(time.Second)))
+	return tokens, ok, wait, full
+}
+
+type memoryBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// memoryRateLimiter only limits a single instance. Once max buckets are
+// in use the one used least recently makes room for a new key, so a flood
+// of addresses can't grow it without bound or lock out new visitors.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	// lru holds the buckets, the most recently used first
+	lru  *list.List
+	max  int
+	stop chan struct{}
+	once sync.Once
+}
+
+func newMemoryRateLimiter(max int) *memoryRateLimiter {
+	m := &memoryRateLimiter{
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+		max:     max,
+		stop:    make(chan struct{}),
+	}
+	go janitor(m.stop, bucketJanitorInterval, m.clean)
+	return m
+}
+
+func (m *memoryRateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e, ok := m.buckets[key]
+	if ok {
+		m.lru.MoveToFront(e)
+	} else {
+		for len(m.buckets) >= m.max {
+			m.remove(m.lru.Back())
+			rateLimitMetrics.Add("evicted", 1)
+		}
+		e = m.lru.PushFront(&memoryBucket{key: key, tokens: float64(limit.Burst), updated: now})
+		m.buckets[key] = e
+	}
+	b := e.Value.(*memoryBucket)
+	tokens, allowed, wait, full := takeToken(b.tokens, b.updated, now, limit)
+	b.tokens, b.updated, b.full = tokens, now, full
+	return allowed, wait, nil
+}
+
+func (m *memoryRateLimiter) remove(e *list.Element) {
+	m.lru.Remove(e)
+	delete(m.buckets, e.Value.(*memoryBucket).key)
+}
+
+// clean drops buckets that refilled, a new one starts full anyway.
+func (m *memoryRateLimiter) clean() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for e := m.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if now.After(e.Value.(*memoryBucket).full) {
+			m.remove(e)
+		}
+		e = prev
+	}
+}
+
+func (m *memoryRateLimiter) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
+
+// RateBucket is a token bucket in the database, every instance using the
+// same database shares it.
+type RateBucket struct {
+	ID        string `gorm:"primary_key"`
+	Tokens    float64
+	UpdatedAt time.Time
+	FullAt    time.Time `gorm:"index"`
+}
+
+type sqlRateLimiter struct {
+	ur   *UnRustleLogs
+	stop chan struct{}
+	once sync.Once
+}
+
+func newSQLRateLimiter(ur *UnRustleLogs) *sqlRateLimiter {
+	s := &sqlRateLimiter{ur: ur, stop: make(chan struct{})}
+	go janitor(s.stop, bucketJanitorInterval, s.clean)
+	return s
+}
+
+func (s *sqlRateLimiter) Allow(key string, limit RateLimit) (bool, time.Duration, error) {
+	var allowed bool
+	var wait time.Duration
+	err := s.ur.transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		b := RateBucket{ID: key, Tokens: float64(limit.Burst), UpdatedAt: now}
+		err := tx.Where("id = ?", key).First(&b).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		var full time.Time
+		b.Tokens, allowed, wait, full = takeToken(b.Tokens, b.UpdatedAt, now, limit)
+		b.UpdatedAt, b.FullAt = now, full
+		// Save updates by primary key and inserts when nothing matched
+		return tx.Save(&b).Error
+	})
+	return allowed, wait, err
+}
+
+func (s *sqlRateLimiter) clean() {
+	if err := s.ur.db.Where("full_at < ?", time.Now()).Delete(&RateBucket{}).Error; err != nil {
+		logrus.Error(err)
+	}
+}
+
+func (s *sqlRateLimiter) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+// setupRateLimiter replaces the default memory limiter with the configured
+// one and reads the trusted proxies.
+func (ur *UnRustleLogs) setupRateLimiter() error {
+	proxies, err := parseTrustedProxies(ur.config.Server.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	var limiter RateLimiter
+	switch ur.config.RateLimit.Backend {
+	case "", "memory":
+		limiter = newMemoryRateLimiter(defaultMaxBuckets)
+	case "sqlite":
+		limiter = newSQLRateLimiter(ur)
+	default:
+		return fmt.Errorf("unknown rate limit backend %q, use memory or sqlite", ur.config.RateLimit.Backend)
+	}
+	if ur.limiter != nil {
+		ur.limiter.Close()
+	}
+	ur.limiter = limiter
+	ur.trustedProxies = proxies
+	return nil
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	if proxies == nil {
+		proxies = []string{"127.0.0.0/8", "::1/128"}
+	}
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is no ip or cidr", p)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (ur *UnRustleLogs) trustedProxy(ip net.IP) bool {
+	for _, n := range ur.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP is the address the connection came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP only believes the forwarding headers when a trusted
+// proxy sent them. X-Forwarded-For is read from the right so a client
+// can't put itself in front of the address our proxies appended.
+func (ur *UnRustleLogs) resolveClientIP(r *http.Request) string {
+	remote := remoteIP(r)
+	if ip := net.ParseIP(remote); ip == nil || !ur.trustedProxy(ip) {
+		return remote
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		if !ur.trustedProxy(hop) {
+			return hop.String()
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return remote
+}
+
+// clientIPMiddleware resolves the visitor's address once, read it with
+// clientIP.
+func (ur *UnRustleLogs) clientIPMiddleware(c *gin.Context) {
+	c.Set("client_ip", ur.resolveClientIP(c.Request))
+	c.Next()
+}
+
+// clientIP is the visitor's address, gin's ClientIP trusts the forwarding
+// headers from anyone.
+func clientIP(c *gin.Context) string {
+	if ip := c.GetString("client_ip"); ip != "" {
+		return ip
+	}
+	return remoteIP(c.Request)
+}
+
+// ipBucket is the bucket key of ip, ipv6 users get a whole /64 so they
+// can't pick a fresh address for every request.
+func ipBucket(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return "ip:" + ip
+	}
+	return "ip:" + parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// rateLimit limits the routes of group per visitor address. With a cookie,
+// users logged in with it are limited per identity as well, so neither a
+// new address nor another login gets around the limit.
+//
+// Only the sqlite limiter fails, when its database does. Requests are
+// refused then instead of going through unlimited: every limited route
+// needs the database anyway and mails mustn't go out unchecked.
+func (ur *UnRustleLogs) rateLimit(group, cookie string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := ur.config.RateLimit.limit(group)
+		if limit.PerMinute < 0 {
+			c.Next()
+			return
+		}
+		keys := []string{group + ":" + ipBucket(clientIP(c))}
+		if cookie != "" {
+			if s, _, err := ur.cookieSession(c, cookie); err == nil {
+				keys = append(keys, group+":user:"+s.UserID)
+			}
+		}
+		for _, key := range keys {
+			ok, wait, err := ur.limiter.Allow(key, limit)
+			if err != nil {
+				logrus.Error(err)
+				rateLimitMetrics.Add("errors", 1)
+				ur.errorPage(c, http.StatusServiceUnavailable, ErrorPayload{
+					Title:   "Try again later",
+					Message: "Something went wrong on our side, please try again in a few minutes.",
+					Back:    "/",
+				})
+				c.Abort()
+				return
+			}
+			if !ok {
+				rateLimitMetrics.Add(group, 1)
+				seconds := int(math.Ceil(wait.Seconds()))
+				if seconds < 1 {
+					seconds = 1
+				}
+				c.Header("Retry-After", strconv.Itoa(seconds))
+				ur.errorPage(c, http.StatusTooManyRequests, ErrorPayload{
+					Title:   "Slow down",
+					Message: fmt.Sprintf("Too many requests, please try again in %d seconds.", seconds),
+					Back:    "/",
+				})
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
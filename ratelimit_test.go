@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTakeToken(t *testing.T) {
+	start := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+	limit := RateLimit{PerMinute: 6, Burst: 3}
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		left    float64
+		ok      bool
+		wait    time.Duration
+		full    time.Duration
+	}{
+		{"full bucket", 3, 0, 2, true, 0, 10 * time.Second},
+		{"last token", 1, 0, 0, true, 0, 30 * time.Second},
+		{"empty bucket", 0, 0, 0, false, 10 * time.Second, 30 * time.Second},
+		{"partly refilled", 0, 4 * time.Second, 0.4, false, 6 * time.Second, 26 * time.Second},
+		{"refilled a token", 0, 10 * time.Second, 0, true, 0, 30 * time.Second},
+		{"refill stops at burst", 1, time.Hour, 2, true, 0, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		now := start.Add(tt.elapsed)
+		left, ok, wait, full := takeToken(tt.tokens, start, now, limit)
+		if math.Abs(left-tt.left) > 1e-9 || ok != tt.ok {
+			t.Errorf("%s: left %v ok %v, want %v %v", tt.name, left, ok, tt.left, tt.ok)
+		}
+		if (wait - tt.wait).Round(time.Millisecond) != 0 {
+			t.Errorf("%s: wait %v, want %v", tt.name, wait, tt.wait)
+		}
+		if (full.Sub(now) - tt.full).Round(time.Millisecond) != 0 {
+			t.Errorf("%s: full in %v, want %v", tt.name, full.Sub(now), tt.full)
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	m := newMemoryRateLimiter(2)
+	defer m.Close()
+	limit := RateLimit{PerMinute: 1, Burst: 2}
+
+	for i, want := range []bool{true, true, false} {
+		ok, wait, err := m.Allow("a", limit)
+		if err != nil || ok != want {
+			t.Fatalf("request %d: ok %v err %v, want %v", i, ok, err, want)
+		}
+		if !ok && wait <= 0 {
+			t.Errorf("request %d: no wait when limited", i)
+		}
+	}
+	if ok, _, err := m.Allow("b", limit); !ok || err != nil {
+		t.Errorf("other key: ok %v err %v, want its own bucket", ok, err)
+	}
+	// b was used last, a makes room for c
+	if ok, _, err := m.Allow("b", limit); !ok || err != nil {
+		t.Errorf("other key again: ok %v err %v", ok, err)
+	}
+	if ok, _, err := m.Allow("c", limit); !ok || err != nil {
+		t.Errorf("over max buckets: ok %v err %v, want the oldest bucket evicted", ok, err)
+	}
+	if _, ok := m.buckets["a"]; ok || len(m.buckets) != 2 {
+		t.Errorf("buckets %v, want a evicted", m.buckets)
+	}
+	if ok, _, _ := m.Allow("b", limit); ok {
+		t.Error("b kept its bucket, want it limited")
+	}
+
+	// refilled buckets are dropped by the janitor
+	m.mu.Lock()
+	for _, e := range m.buckets {
+		e.Value.(*memoryBucket).full = time.Now().Add(-time.Second)
+	}
+	m.mu.Unlock()
+	m.clean()
+	if len(m.buckets) != 0 || m.lru.Len() != 0 {
+		t.Errorf("%d buckets left after cleaning", len(m.buckets))
+	}
+}
+
+type brokenLimiter struct{}
+
+func (brokenLimiter) Allow(string, RateLimit) (bool, time.Duration, error) {
+	return false, 0, errors.New("database is locked")
+}
+
+func (brokenLimiter) Close() error {
+	return nil
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ur := testRustle(t, &Session{})
+	ur.config.Server.JWTSecret = testSecret
+	ur.config.RateLimit.Login = RateLimit{PerMinute: 1, Burst: 2}
+	ur.limiter = newMemoryRateLimiter(defaultMaxBuckets)
+	defer ur.limiter.Close()
+
+	login := func(user string) string {
+		s := &Session{ID: "session-" + user, UserID: user, ExpiresAt: time.Now().Add(time.Hour)}
+		if err := ur.db.Create(s).Error; err != nil {
+			t.Fatal(err)
+		}
+		claims := &jwtClaims{s.UserID, ur.standardClaims(loginAudience, s.ExpiresAt)}
+		claims.Id = s.ID
+		token, err := ur.signJWT(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tokens := map[string]string{"a": login("a"), "b": login("b"), "c": login("c")}
+
+	router := gin.New()
+	router.LoadHTMLGlob("templates/*")
+	router.GET("/", ur.rateLimit(limitLogin, "session"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	get := func(ip, user string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":1234"
+		if user != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: tokens[user]})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	steps := []struct {
+		name string
+		ip   string
+		user string
+		want int
+	}{
+		{"first login", "192.0.2.1", "a", http.StatusOK},
+		{"second login", "192.0.2.1", "b", http.StatusOK},
+		{"another login on a drained address", "192.0.2.1", "c", http.StatusTooManyRequests},
+		{"drained address logged out", "192.0.2.1", "", http.StatusTooManyRequests},
+		{"first login elsewhere", "192.0.2.2", "a", http.StatusOK},
+		{"drained login on a fresh address", "192.0.2.3", "a", http.StatusTooManyRequests},
+		{"fresh address logged out", "192.0.2.3", "", http.StatusOK},
+	}
+	for _, st := range steps {
+		if got := get(st.ip, st.user); got != st.want {
+			t.Errorf("%s: status %d, want %d", st.name, got, st.want)
+		}
+	}
+
+	// a limiter that can't check the limit refuses
+	ur.limiter = brokenLimiter{}
+	if got := get("192.0.2.4", ""); got != http.StatusServiceUnavailable {
+		t.Errorf("broken limiter: status %d, want %d", got, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role of a staff member.
+type Role string
+
+// staff roles
+const (
+	RoleViewer  Role = "viewer"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+	RoleAuditor Role = "auditor"
+)
+
+// Permission is a single action on the admin pages.
+type Permission string
+
+// permissions
+const (
+	PermViewRequests    Permission = "view requests"
+	PermViewEmail       Permission = "view email"
+	PermVerifyIdentity  Permission = "verify identity"
+	PermApproveRequest  Permission = "approve request"
+	PermRejectRequest   Permission = "reject request"
+	PermCompleteRequest Permission = "complete request"
+	PermRunRedaction    Permission = "run redaction"
+	PermViewAudit       Permission = "view audit log"
+	PermRevokeSessions  Permission = "revoke sessions"
+	PermViewMetrics     Permission = "view metrics"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer: {PermViewRequests},
+	RoleSupport: {
+		PermViewRequests,
+		PermViewEmail,
+		PermVerifyIdentity,
+		PermApproveRequest,
+		PermRejectRequest,
+		PermRevokeSessions,
+	},
+	RoleAdmin: {
+		PermViewRequests,
+		PermViewEmail,
+		PermVerifyIdentity,
+		PermApproveRequest,
+		PermRejectRequest,
+		PermCompleteRequest,
+		PermRunRedaction,
+		PermViewAudit,
+		PermRevokeSessions,
+		PermViewMetrics,
+	},
+	RoleAuditor: {PermViewRequests, PermViewEmail, PermViewAudit},
+}
+
+// actionPermissions is the permission needed for each admin action.
+var actionPermissions = map[string]Permission{
+	"verify":          PermVerifyIdentity,
+	"approve":         PermApproveRequest,
+	"reject":          PermRejectRequest,
+	"complete":        PermCompleteRequest,
+	"redact":          PermRunRedaction,
+	"revoke-sessions": PermRevokeSessions,
+}
+
+// StaffRole assigns a role to a provider identity, roles from the config
+// file are not stored here.
+type StaffRole struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	Service string `gorm:"index:idx_staff_identity"`
+	UserID  string `gorm:"index:idx_staff_identity"`
+	Role    Role
+}
+
+// Staff is a logged in user with at least one role.
+type Staff struct {
+	*User
+	Roles []Role
+}
+
+// Can reports whether any role of the staff member grants perm.
+func (s *Staff) Can(perm Permission) bool {
+	for _, r := range s.Roles {
+		for _, p := range rolePermissions[r] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Actor formats the staff member for request histories.
+func (s *Staff) Actor() string {
+	return fmt.Sprintf("%s:%s (%s)", s.Service, s.Name, s.UserID)
+}
+
+func validRole(r Role) bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// validateStaffConfig makes sure every role in the config exists.
+func (ur *UnRustleLogs) validateStaffConfig() error {
+	for _, s := range ur.config.Staff {
+		if !validRole(Role(s.Role)) {
+			return fmt.Errorf("staff %s:%s has unknown role %q", s.Service, s.UserID, s.Role)
+		}
+	}
+	return nil
+}
+
+// StaffRoles returns the roles of a provider identity from config and database.
+func (ur *UnRustleLogs) StaffRoles(service, userID string) []Role {
+	var roles []Role
+	seen := map[Role]bool{}
+	add := func(r Role) {
+		if validRole(r) && !seen[r] {
+			seen[r] = true
+			roles = append(roles, r)
+		}
+	}
+	for _, s := range ur.config.Staff {
+		if s.Service == service && s.UserID == userID {
+			add(Role(s.Role))
+		}
+	}
+	var stored []StaffRole
+	ur.db.Where("service = ? and user_id = ?", service, userID).Find(&stored)
+	for _, s := range stored {
+		add(s.Role)
+	}
+	return roles
+}
+
+// currentStaff returns the first logged in identity that has a role.
+func (ur *UnRustleLogs) currentStaff(c *gin.Context) (*Staff, bool) {
+	if s, ok := c.Get("staff"); ok {
+		return s.(*Staff), true
+	}
+	for _, cookie := range ur.providerCookies() {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			continue
+		}
+		if roles := ur.StaffRoles(user.Service, user.UserID); len(roles) > 0 {
+			s := &Staff{User: user, Roles: roles}
+			c.Set("staff", s)
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// requirePermission only lets staff with perm through.
+func (ur *UnRustleLogs) requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := ur.currentStaff(c)
+		if !ok {
+			c.String(http.StatusUnauthorized, "log in with a staff account first")
+			c.Abort()
+			return
+		}
+		if !s.Can(perm) {
+			c.String(http.StatusForbidden, "you are missing the %q permission", perm)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// staffCan reports whether the current staff member has perm.
+func (ur *UnRustleLogs) staffCan(c *gin.Context, perm Permission) bool {
+	s, ok := ur.currentStaff(c)
+	return ok && s.Can(perm)
+}
+
+func (ur *UnRustleLogs) roleCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: role grant|revoke|list [flags]")
+	}
+	fs := flag.NewFlagSet("role "+args[0], flag.ContinueOnError)
+	service := fs.String("service", "", "service of the identity, e.g. twitch, destinygg or discord")
+	userID := fs.String("user-id", "", "user id at the service")
+	role := fs.String("role", "", "one of viewer, support, admin, auditor")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		for _, s := range ur.config.Staff {
+			fmt.Printf("%s\t%s\t%s\tconfig\n", s.Service, s.UserID, s.Role)
+		}
+		var stored []StaffRole
+		if err := ur.db.Order("service, user_id").Find(&stored).Error; err != nil {
+			return err
+		}
+		for _, s := range stored {
+			fmt.Printf("%s\t%s\t%s\t%s\n", s.Service, s.UserID, s.Role, s.CreatedAt.Format("2006-01-02"))
+		}
+		return nil
+	case "grant", "revoke":
+	default:
+		return fmt.Errorf("unknown role command %q", args[0])
+	}
+
+	if *service == "" || *userID == "" || !validRole(Role(*role)) {
+		fs.Usage()
+		return fmt.Errorf("-service, -user-id and a valid -role are required")
+	}
+	r := StaffRole{
+		Service: strings.ToLower(*service),
+		UserID:  *userID,
+		Role:    Role(*role),
+	}
+	if args[0] == "revoke" {
+		res := ur.db.Where("service = ? and user_id = ? and role = ?", r.Service, r.UserID, r.Role).Delete(&StaffRole{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			ur.audit(cliActor, AuditRoleRevoke, staffSubject(r.Service, r.UserID), string(r.Role))
+		}
+		return nil
+	}
+	var count int
+	ur.db.Model(&StaffRole{}).Where("service = ? and user_id = ? and role = ?", r.Service, r.UserID, r.Role).Count(&count)
+	if count > 0 {
+		return nil
+	}
+	if err := ur.db.Create(&r).Error; err != nil {
+		return err
+	}
+	ur.audit(cliActor, AuditRoleGrant, staffSubject(r.Service, r.UserID), string(r.Role))
+	return nil
+}
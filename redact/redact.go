@@ -0,0 +1,345 @@
+// Package redact removes the lines of specific chatters from an
+// OverRustleLogs archive.
+//
+// The archive is laid out as
+//
+//	<Channel> chatlog/<Month Year>/<yyyy-mm-dd>.txt
+//
+// where every line looks like
+//
+//	[2019-01-02 03:04:05 UTC] nick: message
+package redact
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mode decides what happens to a matched line.
+type Mode int
+
+const (
+	// Remove drops matched lines from the file.
+	Remove Mode = iota
+	// Mask keeps the timestamp of matched lines but replaces nick and message.
+	Mask
+)
+
+func (m Mode) String() string {
+	if m == Mask {
+		return "mask"
+	}
+	return "remove"
+}
+
+// DefaultMask replaces nick and message of masked lines.
+const DefaultMask = "<redacted>"
+
+const (
+	timestampLayout = "2006-01-02 15:04:05 MST"
+	monthLayout     = "January 2006"
+	dayLayout       = "2006-01-02"
+	channelSuffix   = " chatlog"
+)
+
+// services whose chats are archived
+const (
+	ServiceTwitch    = "twitch"
+	ServiceDestinygg = "destinygg"
+)
+
+// destinyggChannel is the only channel that isn't a Twitch chat.
+const destinyggChannel = "Destinygg"
+
+// ChannelService returns the service whose users chat in channel.
+func ChannelService(channel string) string {
+	if strings.EqualFold(channel, destinyggChannel) {
+		return ServiceDestinygg
+	}
+	return ServiceTwitch
+}
+
+// Window is a period in which Nick belonged to the requester, a zero From
+// or To leaves that side open. Services limit the window to the channels of
+// those services, without any it covers every channel.
+type Window struct {
+	Nick     string
+	From     time.Time
+	To       time.Time
+	Services []string
+}
+
+// Contains reports whether t falls inside the window.
+func (w Window) Contains(t time.Time) bool {
+	return (w.From.IsZero() || !t.Before(w.From)) && (w.To.IsZero() || !t.After(w.To))
+}
+
+// Covers reports whether the window applies to the channels of service.
+func (w Window) Covers(service string) bool {
+	if len(w.Services) == 0 {
+		return true
+	}
+	for _, s := range w.Services {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Options ...
+type Options struct {
+	// Names are nicks to redact at any time, compared case-insensitively
+	Names []string
+	// Windows limit redaction of a nick to the periods it was owned
+	Windows []Window
+	// Review windows are periods where ownership of a nick is unclear,
+	// matching lines are left alone and only flagged in the report
+	Review []Window
+	Mode   Mode
+	DryRun bool
+	// Mask is written in place of masked lines, defaults to DefaultMask
+	Mask string
+}
+
+// Line is a parsed log line.
+type Line struct {
+	Time    time.Time
+	Nick    string
+	Message string
+}
+
+// FileReport describes what was (or would be in a dry run) changed in one file.
+type FileReport struct {
+	Path    string
+	Channel string
+	Day     time.Time
+	Lines   int
+	Matched int
+	// MatchedLines are the 1-based line numbers that matched
+	MatchedLines []int
+	Flagged      int
+	FlaggedLines []int
+	Changed      bool
+}
+
+// Report ...
+type Report struct {
+	Mode    Mode
+	DryRun  bool
+	Files   []*FileReport
+	Lines   int
+	Matched int
+	Flagged int
+}
+
+// ParseLine parses a single log line, the trailing newline is optional.
+func ParseLine(s string) (Line, bool) {
+	s = strings.TrimRight(s, "\r\n")
+	if !strings.HasPrefix(s, "[") {
+		return Line{}, false
+	}
+	end := strings.Index(s, "] ")
+	if end < 0 {
+		return Line{}, false
+	}
+	t, err := time.Parse(timestampLayout, s[1:end])
+	if err != nil {
+		return Line{}, false
+	}
+	rest := s[end+2:]
+	sep := strings.Index(rest, ": ")
+	if sep <= 0 {
+		return Line{}, false
+	}
+	return Line{
+		Time:    t,
+		Nick:    rest[:sep],
+		Message: rest[sep+2:],
+	}, true
+}
+
+// logFile reports whether path is a day file of the archive and returns its
+// channel and day.
+func logFile(path string) (string, time.Time, bool) {
+	base := filepath.Base(path)
+	if !strings.HasSuffix(base, ".txt") {
+		return "", time.Time{}, false
+	}
+	day, err := time.Parse(dayLayout, strings.TrimSuffix(base, ".txt"))
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	monthDir := filepath.Dir(path)
+	month, err := time.Parse(monthLayout, filepath.Base(monthDir))
+	if err != nil || month.Year() != day.Year() || month.Month() != day.Month() {
+		return "", time.Time{}, false
+	}
+	channelDir := filepath.Base(filepath.Dir(monthDir))
+	if !strings.HasSuffix(channelDir, channelSuffix) {
+		return "", time.Time{}, false
+	}
+	return strings.TrimSuffix(channelDir, channelSuffix), day, true
+}
+
+// Run walks the archive below root and redacts every day file in it.
+func Run(root string, opts Options) (*Report, error) {
+	report := &Report{
+		Mode:   opts.Mode,
+		DryRun: opts.DryRun,
+	}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, _, ok := logFile(path); !ok {
+			return nil
+		}
+		fr, err := File(path, opts)
+		if err != nil {
+			return err
+		}
+		report.Lines += fr.Lines
+		report.Matched += fr.Matched
+		report.Flagged += fr.Flagged
+		if fr.Matched > 0 || fr.Flagged > 0 {
+			report.Files = append(report.Files, fr)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// File redacts a single day file, the file is only rewritten if something
+// matched and opts.DryRun is false.
+func File(path string, opts Options) (*FileReport, error) {
+	fr := &FileReport{Path: path}
+	fr.Channel, fr.Day, _ = logFile(path)
+	service := ChannelService(fr.Channel)
+
+	windows := groupWindows(opts.Windows)
+	for _, n := range opts.Names {
+		k := strings.ToLower(n)
+		windows[k] = append(windows[k], Window{Nick: n})
+	}
+	review := groupWindows(opts.Review)
+	mask := opts.Mask
+	if mask == "" {
+		mask = DefaultMask
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var out *os.File
+	if !opts.DryRun {
+		out, err = ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".redact")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+	}
+
+	r := bufio.NewReader(in)
+	var w *bufio.Writer
+	if out != nil {
+		w = bufio.NewWriter(out)
+	}
+	for {
+		s, err := r.ReadString('\n')
+		if s != "" {
+			fr.Lines++
+			line, ok := ParseLine(s)
+			match := ok && inWindows(windows, service, line)
+			if ok && !match && inWindows(review, service, line) {
+				fr.Flagged++
+				fr.FlaggedLines = append(fr.FlaggedLines, fr.Lines)
+			}
+			if match {
+				fr.Matched++
+				fr.MatchedLines = append(fr.MatchedLines, fr.Lines)
+				if opts.Mode == Mask {
+					s = "[" + line.Time.Format(timestampLayout) + "] " + mask + lineEnding(s)
+				} else {
+					s = ""
+				}
+			}
+			if w != nil {
+				if _, err := w.WriteString(s); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DryRun || fr.Matched == 0 {
+		return fr, nil
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := out.Chmod(info.Mode()); err != nil {
+		return nil, err
+	}
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		return nil, err
+	}
+	fr.Changed = true
+	return fr, nil
+}
+
+func groupWindows(windows []Window) map[string][]Window {
+	m := make(map[string][]Window, len(windows))
+	for _, w := range windows {
+		k := strings.ToLower(w.Nick)
+		m[k] = append(m[k], w)
+	}
+	return m
+}
+
+func inWindows(windows map[string][]Window, service string, line Line) bool {
+	for _, w := range windows[strings.ToLower(line.Nick)] {
+		if w.Covers(service) && w.Contains(line.Time) {
+			return true
+		}
+	}
+	return false
+}
+
+func lineEnding(s string) string {
+	switch {
+	case strings.HasSuffix(s, "\r\n"):
+		return "\r\n"
+	case strings.HasSuffix(s, "\n"):
+		return "\n"
+	}
+	return ""
+}
@@ -0,0 +1,213 @@
+package redact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testLog = "[2019-01-02 03:04:05 UTC] Alice: hi\n" +
+	"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+	"[2019-01-02 05:00:00 UTC] alice: later\r\n" +
+	"not a log line\n" +
+	"[2019-01-02 06:00:00 UTC] Carol: bye"
+
+func at(s string) time.Time {
+	t, err := time.Parse(timestampLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		want    string
+		matched []int
+		flagged []int
+	}{
+		{
+			name: "mask names at any time",
+			opts: Options{Names: []string{"ALICE"}, Mode: Mask},
+			want: "[2019-01-02 03:04:05 UTC] <redacted>\n" +
+				"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+				"[2019-01-02 05:00:00 UTC] <redacted>\r\n" +
+				"not a log line\n" +
+				"[2019-01-02 06:00:00 UTC] Carol: bye",
+			matched: []int{1, 3},
+		},
+		{
+			name: "remove inside a window only",
+			opts: Options{
+				Windows: []Window{{Nick: "alice", From: at("2019-01-02 04:00:00 UTC")}},
+			},
+			want: "[2019-01-02 03:04:05 UTC] Alice: hi\n" +
+				"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+				"not a log line\n" +
+				"[2019-01-02 06:00:00 UTC] Carol: bye",
+			matched: []int{3},
+		},
+		{
+			name: "window ends are inclusive",
+			opts: Options{
+				Windows: []Window{{Nick: "carol", From: at("2019-01-02 06:00:00 UTC"), To: at("2019-01-02 06:00:00 UTC")}},
+				Mode:    Mask,
+				Mask:    "[gone]",
+			},
+			want: "[2019-01-02 03:04:05 UTC] Alice: hi\n" +
+				"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+				"[2019-01-02 05:00:00 UTC] alice: later\r\n" +
+				"not a log line\n" +
+				"[2019-01-02 06:00:00 UTC] [gone]",
+			matched: []int{5},
+		},
+		{
+			name: "review only flags",
+			opts: Options{
+				Windows: []Window{{Nick: "alice", From: at("2019-01-02 04:00:00 UTC")}},
+				Review:  []Window{{Nick: "alice", To: at("2019-01-02 04:00:00 UTC")}, {Nick: "bob"}},
+				Mode:    Mask,
+			},
+			want: "[2019-01-02 03:04:05 UTC] Alice: hi\n" +
+				"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+				"[2019-01-02 05:00:00 UTC] <redacted>\r\n" +
+				"not a log line\n" +
+				"[2019-01-02 06:00:00 UTC] Carol: bye",
+			matched: []int{3},
+			flagged: []int{1, 2},
+		},
+		{
+			name: "windows only cover their services",
+			opts: Options{
+				Windows: []Window{
+					{Nick: "alice", Services: []string{ServiceDestinygg}},
+					{Nick: "carol", Services: []string{ServiceDestinygg, ServiceTwitch}},
+				},
+				Review: []Window{{Nick: "bob", Services: []string{ServiceDestinygg}}},
+			},
+			want: "[2019-01-02 03:04:05 UTC] Alice: hi\n" +
+				"[2019-01-02 03:04:06 UTC] bob: hello alice\n" +
+				"[2019-01-02 05:00:00 UTC] alice: later\r\n" +
+				"not a log line\n",
+			matched: []int{5},
+		},
+		{
+			name:    "dry run leaves the file alone",
+			opts:    Options{Names: []string{"bob", "carol"}, DryRun: true},
+			want:    testLog,
+			matched: []int{2, 5},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "Destiny chatlog", "January 2019", "2019-01-02.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(testLog), 0644); err != nil {
+				t.Fatal(err)
+			}
+			fr, err := File(path, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("file is\n%q\nwant\n%q", got, tt.want)
+			}
+			if !reflect.DeepEqual(fr.MatchedLines, tt.matched) {
+				t.Errorf("matched lines %v, want %v", fr.MatchedLines, tt.matched)
+			}
+			if !reflect.DeepEqual(fr.FlaggedLines, tt.flagged) {
+				t.Errorf("flagged lines %v, want %v", fr.FlaggedLines, tt.flagged)
+			}
+			if fr.Lines != 5 || fr.Channel != "Destiny" {
+				t.Errorf("got %d lines of %q", fr.Lines, fr.Channel)
+			}
+			if changed := !tt.opts.DryRun && len(tt.matched) > 0; fr.Changed != changed {
+				t.Errorf("changed is %v, want %v", fr.Changed, changed)
+			}
+		})
+	}
+}
+
+func TestRunChannels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, channel := range []string{"Destiny", "Destinygg"} {
+		path := filepath.Join(dir, channel+" chatlog", "January 2019", "2019-01-02.txt")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(testLog), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the twitch bob is someone else than the destiny.gg bob
+	report, err := Run(dir, Options{Windows: []Window{{Nick: "bob", Services: []string{ServiceTwitch}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Channel != "Destiny" || report.Matched != 1 {
+		t.Fatalf("matched %d lines in %d files, want 1 line in the Destiny channel", report.Matched, len(report.Files))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "Destinygg chatlog", "January 2019", "2019-01-02.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != testLog {
+		t.Errorf("destiny.gg log changed to\n%q", got)
+	}
+}
+
+func TestChannelService(t *testing.T) {
+	for channel, want := range map[string]string{
+		"Destinygg": ServiceDestinygg,
+		"destinygg": ServiceDestinygg,
+		"Destiny":   ServiceTwitch,
+		"":          ServiceTwitch,
+	} {
+		if got := ChannelService(channel); got != want {
+			t.Errorf("ChannelService(%q) = %q, want %q", channel, got, want)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Line
+		ok   bool
+	}{
+		{"[2019-01-02 03:04:05 UTC] nick: a: b\n", Line{at("2019-01-02 03:04:05 UTC"), "nick", "a: b"}, true},
+		{"[2019-01-02 03:04:05 UTC] nick:", Line{}, false},
+		{"[2019-01-02 03:04:05 UTC] : msg", Line{}, false},
+		{"[yesterday] nick: msg", Line{}, false},
+		{"nick: msg", Line{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseLine(tt.in)
+		if ok != tt.ok || !got.Time.Equal(tt.want.Time) || got.Nick != tt.want.Nick || got.Message != tt.want.Message {
+			t.Errorf("ParseLine(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tensei/unrustlelogs/redact"
+)
+
+// redactJob describes one redaction run for a request.
+type redactJob struct {
+	Request *DeletionRequest
+	Actor   Actor
+	Logs    string
+	Mode    redact.Mode
+	DryRun  bool
+	// Force redacts even if name ownership has conflicts
+	Force bool
+}
+
+type redactResult struct {
+	Windows   []OwnershipWindow
+	Conflicts []OwnershipConflict
+	Report    *redact.Report
+}
+
+var errNoLogs = errors.New("no log archive configured")
+
+// runRedaction redacts the logs of an approved request and completes it,
+// dry runs only report what would change and leave the request alone.
+func (ur *UnRustleLogs) runRedaction(job redactJob) (*redactResult, error) {
+	r := job.Request
+	if job.Logs == "" {
+		return nil, errNoLogs
+	}
+	user, ok := ur.GetUser(r.UserID)
+	if !ok {
+		return nil, fmt.Errorf("user of request %q not found", r.ID)
+	}
+	// processing requests can be run again if a previous run failed
+	if !job.DryRun && r.Status != StatusApproved && r.Status != StatusProcessing {
+		return nil, fmt.Errorf("request %q is %s, only approved requests can be redacted", r.ID, r.Status)
+	}
+
+	res := &redactResult{}
+	res.Windows, res.Conflicts = ur.PersonWindows(user)
+	if len(res.Conflicts) > 0 && !job.DryRun && !job.Force {
+		return res, fmt.Errorf("request %q has %d name ownership conflicts, they need a manual review", r.ID, len(res.Conflicts))
+	}
+
+	opts := redact.Options{
+		Mode:   job.Mode,
+		DryRun: job.DryRun,
+	}
+	opts.Windows, opts.Review = redactWindows(res.Windows)
+
+	if !job.DryRun && r.Status == StatusApproved {
+		if _, err := ur.TransitionRequest(r.ID, StatusProcessing, job.Actor, "redacting "+job.Logs); err != nil {
+			return res, err
+		}
+	}
+	report, err := redact.Run(job.Logs, opts)
+	if err != nil {
+		ur.audit(job.Actor, AuditRedactionRun, "request:"+r.ID, "failed: "+err.Error())
+		return res, err
+	}
+	res.Report = report
+	note := fmt.Sprintf("%s %d lines in %d files, %d lines need review", report.Mode, report.Matched, len(report.Files), report.Flagged)
+	if job.DryRun {
+		ur.audit(job.Actor, AuditRedactionRun, "request:"+r.ID, "dry run: "+note)
+		return res, nil
+	}
+	ur.audit(job.Actor, AuditRedactionRun, "request:"+r.ID, note)
+	_, err = ur.TransitionRequest(r.ID, StatusCompleted, job.Actor, note)
+	return res, err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestStatus is the stage a DeletionRequest is currently in.
+type RequestStatus string
+
+// deletion request lifecycle
+const (
+	StatusSubmitted        RequestStatus = "submitted"
+	StatusIdentityVerified RequestStatus = "identity_verified"
+	StatusApproved         RequestStatus = "approved"
+	StatusProcessing       RequestStatus = "processing"
+	StatusCompleted        RequestStatus = "completed"
+	StatusRejected         RequestStatus = "rejected"
+	StatusWithdrawn        RequestStatus = "withdrawn"
+)
+
+// requestTransitions lists which statuses a request may move to from its
+// current one, anything not listed here is refused.
+var requestTransitions = map[RequestStatus][]RequestStatus{
+	StatusSubmitted:        {StatusIdentityVerified, StatusRejected, StatusWithdrawn},
+	StatusIdentityVerified: {StatusApproved, StatusRejected, StatusWithdrawn},
+	// approved requests can be completed directly if the logs were removed by hand
+	StatusApproved:   {StatusProcessing, StatusCompleted, StatusRejected, StatusWithdrawn},
+	StatusProcessing: {StatusCompleted, StatusRejected},
+	StatusCompleted:  {},
+	StatusRejected:   {},
+	StatusWithdrawn:  {},
+}
+
+// ErrInvalidTransition is returned when a status change isn't allowed
+// from the request's current status.
+var ErrInvalidTransition = errors.New("invalid request status transition")
+
+// CanTransition reports whether a request in status s may move to status to.
+func (s RequestStatus) CanTransition(to RequestStatus) bool {
+	for _, next := range requestTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Open reports whether the request is still being worked on.
+func (s RequestStatus) Open() bool {
+	return len(requestTransitions[s]) > 0
+}
+
+// openStatuses returns every status that is still being worked on.
+func openStatuses() []RequestStatus {
+	var open []RequestStatus
+	for s := range requestTransitions {
+		if s.Open() {
+			open = append(open, s)
+		}
+	}
+	return open
+}
+
+// DeletionRequest is a users request to have their logs removed.
+type DeletionRequest struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	UserID string `gorm:"index"`
+	Status RequestStatus
+
+	// Email is the address the requester proved they own
+	Email           string
+	EmailVerifiedAt *time.Time
+
+	// ClientIP and Session are where the request was submitted from, they
+	// are only kept to spot mass submissions
+	ClientIP string `gorm:"index"`
+	Session  string `gorm:"index"`
+}
+
+// RequestTransition is one entry in the append-only history of a request,
+// rows are only ever inserted.
+type RequestTransition struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+
+	RequestID string `gorm:"index"`
+	From      RequestStatus
+	To        RequestStatus
+	Actor     string
+	Note      string
+}
+
+// userActorName formats a user as the actor of a request transition, only
+// the random id is stored so the history holds nothing personal.
+func userActorName(u *User) string {
+	return "user:" + u.ID
+}
+
+// CreateDeletionRequest opens a new request for the user, if the user
+// already has an open request that one is returned instead. session is the
+// id of the login session it was submitted with.
+func (ur *UnRustleLogs) CreateDeletionRequest(userID string, actor Actor, session string) (*DeletionRequest, error) {
+	if r, ok := ur.OpenDeletionRequest(userID); ok {
+		return r, nil
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	r := &DeletionRequest{
+		ID:       id.String(),
+		UserID:   userID,
+		Status:   StatusSubmitted,
+		ClientIP: actor.IP,
+		Session:  session,
+	}
+	err = ur.auditTransaction(func(tx *gorm.DB) error {
+		if err := tx.Create(r).Error; err != nil {
+			return err
+		}
+		err := tx.Create(&RequestTransition{
+			RequestID: r.ID,
+			To:        StatusSubmitted,
+			Actor:     actor.Name,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return ur.appendAudit(tx, actor, AuditRequestCreate, "request:"+r.ID, "user:"+userID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TransitionRequest moves a request to a new status and records who did it.
+func (ur *UnRustleLogs) TransitionRequest(id string, to RequestStatus, actor Actor, note string) (*DeletionRequest, error) {
+	var r DeletionRequest
+	err := ur.auditTransaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id = ?", id).First(&r).Error; err != nil {
+			return err
+		}
+		from := r.Status
+		if !from.CanTransition(to) {
+			return ErrInvalidTransition
+		}
+		// only update if nobody else moved the request in the meantime
+		res := tx.Model(&r).Where("status = ?", from).Update("status", to)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidTransition
+		}
+		err := tx.Create(&RequestTransition{
+			RequestID: r.ID,
+			From:      from,
+			To:        to,
+			Actor:     actor.Name,
+			Note:      note,
+		}).Error
+		if err != nil {
+			return err
+		}
+		details := fmt.Sprintf("%s -> %s", from, to)
+		if note != "" {
+			details += ": " + note
+		}
+		return ur.appendAudit(tx, actor, AuditRequestTransition, "request:"+r.ID, details)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ur.statusBroker.publish(r.ID, to)
+	if to == StatusIdentityVerified {
+		approved, _ := ur.autoApprove(&r)
+		return approved, nil
+	}
+	return &r, nil
+}
+
+// GetDeletionRequest ...
+func (ur *UnRustleLogs) GetDeletionRequest(id string) (*DeletionRequest, bool) {
+	var r DeletionRequest
+	ur.db.Where("id = ?", id).First(&r)
+	return &r, r.ID == id
+}
+
+// OpenDeletionRequest returns the request that is still in progress for the
+// user or any identity linked to them.
+func (ur *UnRustleLogs) OpenDeletionRequest(userID string) (*DeletionRequest, bool) {
+	var requests []DeletionRequest
+	ur.db.Where("user_id in (?)", ur.linkedUserIDs(userID)).Order("created_at desc").Find(&requests)
+	for i := range requests {
+		if requests[i].Status.Open() {
+			return &requests[i], true
+		}
+	}
+	return nil, false
+}
+
+// LatestDeletionRequest returns the most recent request of the user or any
+// identity linked to them.
+func (ur *UnRustleLogs) LatestDeletionRequest(userID string) (*DeletionRequest, bool) {
+	var r DeletionRequest
+	ur.db.Where("user_id in (?)", ur.linkedUserIDs(userID)).Order("created_at desc").First(&r)
+	return &r, r.ID != ""
+}
+
+// RequestHistory returns every transition of the request, oldest first.
+func (ur *UnRustleLogs) RequestHistory(id string) []RequestTransition {
+	var history []RequestTransition
+	ur.db.Where("request_id = ?", id).Order("id asc").Find(&history)
+	return history
+}
+
+// submitRequestHandle opens a deletion request for the user logged in
+// with the given cookie and sends them back to redirect.
+func (ur *UnRustleLogs) submitRequestHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, user, ok := ur.currentSession(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		if _, err := ur.CreateDeletionRequest(user.ID, ur.actor(c, userActorName(user)), session.ID); err != nil {
+			logrus.Error(err)
+		}
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
+
+// withdrawRequestHandle withdraws the open request of the user logged in
+// with the given cookie.
+func (ur *UnRustleLogs) withdrawRequestHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		if r, ok := ur.OpenDeletionRequest(user.ID); ok {
+			if _, err := ur.TransitionRequest(r.ID, StatusWithdrawn, ur.actor(c, userActorName(user)), "withdrawn by requester"); err != nil {
+				logrus.Error(err)
+			}
+		}
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
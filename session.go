@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionIdle logs out sessions that weren't used for this long
+	sessionIdle = time.Hour * 24 * 7
+	// sessionMaxAge logs out every session eventually, used or not
+	sessionMaxAge = time.Hour * 24 * 31
+	// sessionRefresh is how often a session in use gets a fresh token
+	sessionRefresh = time.Hour * 24
+	// sessionSeen limits how often last seen is written
+	sessionSeen = time.Minute * 5
+
+	userAgentMaxLength = 256
+)
+
+var errSessionInvalid = errors.New("session is unknown, revoked or expired")
+
+// Session is a login, the id is the jti of its token. Tokens are only
+// valid as long as their session is.
+type Session struct {
+	ID         string `gorm:"primary_key"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+	RevokedAt  *time.Time
+
+	UserID    string `gorm:"index"`
+	Service   string
+	ClientIP  string
+	UserAgent string
+}
+
+// Active reports whether the session can still be used.
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+// sessionExpiry is when a session used at now expires.
+func sessionExpiry(created, now time.Time) time.Time {
+	expires := now.Add(sessionIdle)
+	if max := created.Add(sessionMaxAge); expires.After(max) {
+		return max
+	}
+	return expires
+}
+
+// CreateSession starts a session for the user logging in through c.
+func (ur *UnRustleLogs) CreateSession(c *gin.Context, user *User) (*Session, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ua := c.Request.UserAgent()
+	if len(ua) > userAgentMaxLength {
+		ua = ua[:userAgentMaxLength]
+	}
+	s := &Session{
+		ID:         id.String(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  sessionExpiry(now, now),
+		UserID:     user.ID,
+		Service:    user.Service,
+		ClientIP:   clientIP(c),
+		UserAgent:  ua,
+	}
+	if err := ur.db.Create(s).Error; err != nil {
+		return nil, err
+	}
+	// nothing can use them anymore
+	if err := ur.db.Where("expires_at < ?", now).Delete(&Session{}).Error; err != nil {
+		logrus.Error(err)
+	}
+	return s, nil
+}
+
+// cookieSession returns the session behind the token in cookie.
+func (ur *UnRustleLogs) cookieSession(c *gin.Context, cookie string) (*Session, *jwtClaims, error) {
+	token, err := c.Cookie(cookie)
+	if err != nil {
+		return nil, nil, err
+	}
+	claims := &jwtClaims{}
+	if err := ur.parseJWT(token, claims, loginAudience); err != nil {
+		return nil, nil, err
+	}
+	// tokens from before sessions have no id
+	if claims.Id == "" {
+		return nil, nil, errSessionInvalid
+	}
+	var s Session
+	if err := ur.db.Where("id = ?", claims.Id).First(&s).Error; err != nil {
+		return nil, nil, errSessionInvalid
+	}
+	if !s.Active() || s.UserID != claims.ID {
+		return nil, nil, errSessionInvalid
+	}
+	return &s, claims, nil
+}
+
+// currentSession returns the session and user logged in with cookie, an
+// invalid cookie is removed.
+func (ur *UnRustleLogs) currentSession(c *gin.Context, cookie string) (*Session, *User, bool) {
+	s, claims, err := ur.cookieSession(c, cookie)
+	if err == http.ErrNoCookie {
+		return nil, nil, false
+	}
+	if err != nil {
+		logrus.Infof("%s login dropped: %v", cookie, err)
+		ur.deleteCookie(c, cookie)
+		return nil, nil, false
+	}
+	user, ok := ur.GetUser(s.UserID)
+	if !ok {
+		ur.deleteCookie(c, cookie)
+		return nil, nil, false
+	}
+	ur.touchSession(c, cookie, s, claims)
+	return s, user, true
+}
+
+// loggedInAs reports whether the browser has a session of the user with id.
+func (ur *UnRustleLogs) loggedInAs(c *gin.Context, id string) bool {
+	for _, cookie := range ur.providerCookies() {
+		if s, _, err := ur.cookieSession(c, cookie); err == nil && s.UserID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// touchSession records that s was used and moves its expiry forward once a
+// day, the cookie gets a token with the new expiry then.
+func (ur *UnRustleLogs) touchSession(c *gin.Context, cookie string, s *Session, claims *jwtClaims) {
+	now := time.Now()
+	refresh := now.Sub(time.Unix(claims.IssuedAt, 0)) > sessionRefresh
+	if !refresh && now.Sub(s.LastSeenAt) < sessionSeen {
+		return
+	}
+	updates := map[string]interface{}{"last_seen_at": now}
+	if refresh {
+		updates["expires_at"] = sessionExpiry(s.CreatedAt, now)
+	}
+	res := ur.db.Model(s).Where("revoked_at is null").Updates(updates)
+	if res.Error != nil {
+		logrus.Error(res.Error)
+		return
+	}
+	if refresh && res.RowsAffected > 0 {
+		if err := ur.writeSessionCookie(c, cookie, s); err != nil {
+			logrus.Error(err)
+		}
+	}
+}
+
+// writeSessionCookie stores a token for s in cookie, both expire with s.
+func (ur *UnRustleLogs) writeSessionCookie(c *gin.Context, cookie string, s *Session) error {
+	claims := &jwtClaims{s.UserID, ur.standardClaims(loginAudience, s.ExpiresAt)}
+	claims.Id = s.ID
+	t, err := ur.signJWT(claims)
+	if err != nil {
+		return err
+	}
+	maxAge := int(time.Until(s.ExpiresAt) / time.Second)
+	// lax so links from other sites still arrive logged in
+	setCookie(c, cookie, t, maxAge, http.SameSiteLaxMode)
+	return nil
+}
+
+// EndSession revokes a single session, e.g. on logout.
+func (ur *UnRustleLogs) EndSession(id string) error {
+	return ur.db.Model(&Session{}).Where("id = ? and revoked_at is null", id).Update("revoked_at", time.Now()).Error
+}
+
+// RevokeSessions ends every session of the user and the identities linked
+// to them.
+func (ur *UnRustleLogs) RevokeSessions(actor Actor, user *User, reason string) (int64, error) {
+	now := time.Now()
+	res := ur.db.Model(&Session{}).
+		Where("user_id in (?) and revoked_at is null and expires_at > ?", ur.linkedUserIDs(user.ID), now).
+		Update("revoked_at", now)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	ur.audit(actor, AuditSessionRevoke, "user:"+user.ID, fmt.Sprintf("%d sessions: %s", res.RowsAffected, reason))
+	return res.RowsAffected, nil
+}
+
+// UserSessions returns the active sessions of the user and the identities
+// linked to them, most recently used first.
+func (ur *UnRustleLogs) UserSessions(user *User) []Session {
+	var sessions []Session
+	ur.db.Where("user_id in (?) and revoked_at is null and expires_at > ?", ur.linkedUserIDs(user.ID), time.Now()).
+		Order("last_seen_at desc").
+		Find(&sessions)
+	return sessions
+}
+
+// logoutAllHandle ends every session of the user logged in with cookie.
+func (ur *UnRustleLogs) logoutAllHandle(cookie, redirect string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		if _, err := ur.RevokeSessions(ur.actor(c, userActorName(user)), user, "logged out everywhere"); err != nil {
+			logrus.Error(err)
+			c.Redirect(http.StatusFound, redirect)
+			return
+		}
+		for _, cookie := range ur.providerCookies() {
+			ur.deleteCookie(c, cookie)
+		}
+		c.Redirect(http.StatusFound, redirect)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxStates = 10000
+	// stateJanitorInterval is how often expired states are dropped
+	stateJanitorInterval = time.Minute
+)
+
+var errStateStoreFull = errors.New("too many logins in progress")
+
+// stateMetrics are shared by every store, see /admin/debug/vars.
+var stateMetrics = expvar.NewMap("oauth_states")
+
+// StateStore keeps the oauth state between the login redirect and the
+// callback.
+type StateStore interface {
+	// Put stores s under key until ttl passes, a full store refuses
+	Put(key string, s *oauthState, ttl time.Duration) error
+	// Take returns and removes the state, every state can only be used once
+	Take(key string) (*oauthState, bool, error)
+	Close() error
+}
+
+// janitor calls clean every interval until stop is closed.
+func janitor(stop <-chan struct{}, interval time.Duration, clean func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			clean()
+		case <-stop:
+			return
+		}
+	}
+}
+
+type memoryState struct {
+	state   *oauthState
+	expires time.Time
+}
+
+// memoryStateStore only works for a single instance, states are lost on a
+// restart.
+type memoryStateStore struct {
+	mu     sync.Mutex
+	states map[string]memoryState
+	max    int
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newMemoryStateStore(max int) *memoryStateStore {
+	m := &memoryStateStore{
+		states: make(map[string]memoryState),
+		max:    max,
+		stop:   make(chan struct{}),
+	}
+	go janitor(m.stop, stateJanitorInterval, m.clean)
+	return m
+}
+
+func (m *memoryStateStore) Put(key string, s *oauthState, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.states) >= m.max {
+		m.cleanLocked()
+	}
+	if len(m.states) >= m.max {
+		stateMetrics.Add("rejected", 1)
+		return errStateStoreFull
+	}
+	m.states[key] = memoryState{state: s, expires: time.Now().Add(ttl)}
+	stateMetrics.Add("created", 1)
+	m.setStored()
+	return nil
+}
+
+func (m *memoryStateStore) Take(key string) (*oauthState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms, ok := m.states[key]
+	if ok {
+		delete(m.states, key)
+		m.setStored()
+	}
+	if !ok || time.Now().After(ms.expires) {
+		stateMetrics.Add("missing", 1)
+		return nil, false, nil
+	}
+	stateMetrics.Add("taken", 1)
+	return ms.state, true, nil
+}
+
+func (m *memoryStateStore) clean() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanLocked()
+}
+
+func (m *memoryStateStore) cleanLocked() {
+	now := time.Now()
+	for key, ms := range m.states {
+		if now.After(ms.expires) {
+			delete(m.states, key)
+			stateMetrics.Add("expired", 1)
+		}
+	}
+	m.setStored()
+}
+
+func (m *memoryStateStore) setStored() {
+	stored := new(expvar.Int)
+	stored.Set(int64(len(m.states)))
+	stateMetrics.Set("stored", stored)
+}
+
+func (m *memoryStateStore) Close() error {
+	m.once.Do(func() { close(m.stop) })
+	return nil
+}
+
+// OAuthState is an oauthState in the database, every instance using the
+// same database can finish a login another one started.
+type OAuthState struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+	ExpiresAt time.Time `gorm:"index"`
+
+	Service  string
+	Verifier string
+	Nonce    string
+	LinkUser string
+}
+
+type sqlStateStore struct {
+	db   *gorm.DB
+	max  int
+	stop chan struct{}
+	once sync.Once
+}
+
+func newSQLStateStore(db *gorm.DB, max int) *sqlStateStore {
+	s := &sqlStateStore{db: db, max: max, stop: make(chan struct{})}
+	go janitor(s.stop, stateJanitorInterval, s.clean)
+	return s
+}
+
+func (s *sqlStateStore) Put(key string, state *oauthState, ttl time.Duration) error {
+	var count int
+	if err := s.db.Model(&OAuthState{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count >= s.max {
+		s.clean()
+		s.db.Model(&OAuthState{}).Count(&count)
+	}
+	if count >= s.max {
+		stateMetrics.Add("rejected", 1)
+		return errStateStoreFull
+	}
+	err := s.db.Create(&OAuthState{
+		ID:        key,
+		CreatedAt: state.Created,
+		ExpiresAt: time.Now().Add(ttl),
+		Service:   state.Service,
+		Verifier:  state.Verifier,
+		Nonce:     state.Nonce,
+		LinkUser:  state.LinkUser,
+	}).Error
+	if err != nil {
+		return err
+	}
+	stateMetrics.Add("created", 1)
+	return nil
+}
+
+func (s *sqlStateStore) Take(key string) (*oauthState, bool, error) {
+	var row OAuthState
+	err := s.db.Where("id = ?", key).First(&row).Error
+	if gorm.IsRecordNotFoundError(err) {
+		stateMetrics.Add("missing", 1)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// only the instance that deletes the row gets to use it
+	res := s.db.Where("id = ?", key).Delete(&OAuthState{})
+	if res.Error != nil {
+		return nil, false, res.Error
+	}
+	if res.RowsAffected == 0 || time.Now().After(row.ExpiresAt) {
+		stateMetrics.Add("missing", 1)
+		return nil, false, nil
+	}
+	stateMetrics.Add("taken", 1)
+	return &oauthState{
+		Service:  row.Service,
+		Verifier: row.Verifier,
+		Nonce:    row.Nonce,
+		Created:  row.CreatedAt,
+		LinkUser: row.LinkUser,
+	}, true, nil
+}
+
+func (s *sqlStateStore) clean() {
+	res := s.db.Where("expires_at < ?", time.Now()).Delete(&OAuthState{})
+	if res.Error != nil {
+		logrus.Error(res.Error)
+		return
+	}
+	stateMetrics.Add("expired", res.RowsAffected)
+	var count int
+	s.db.Model(&OAuthState{}).Count(&count)
+	stored := new(expvar.Int)
+	stored.Set(int64(count))
+	stateMetrics.Set("stored", stored)
+}
+
+func (s *sqlStateStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+// setupStateStore replaces the default memory store with the configured
+// one.
+func (ur *UnRustleLogs) setupStateStore() error {
+	max := ur.config.Server.MaxStates
+	if max <= 0 {
+		max = defaultMaxStates
+	}
+	var store StateStore
+	switch ur.config.Server.StateStore {
+	case "", "memory":
+		store = newMemoryStateStore(max)
+	case "sqlite":
+		store = newSQLStateStore(ur.db, max)
+	default:
+		return fmt.Errorf("unknown state store %q, use memory or sqlite", ur.config.Server.StateStore)
+	}
+	if ur.states != nil {
+		ur.states.Close()
+	}
+	ur.states = store
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	statusAudience = "status"
+	// status links are meant to be bookmarked
+	statusTokenTTL = time.Hour * 24 * 180
+	// streams end before the servers write timeout, EventSource reconnects
+	// on its own after statusRetry
+	statusStreamDuration = time.Second * 8
+	statusRetry          = 2000
+)
+
+type statusClaims struct {
+	Request string `json:"rid"`
+	jwt.StandardClaims
+}
+
+// StatusStage is one step of the progress shown to requesters.
+type StatusStage struct {
+	Label   string
+	Done    bool
+	Current bool
+}
+
+// StatusRequest is a request as shown on the status page.
+type StatusRequest struct {
+	Request  *DeletionRequest
+	Service  string
+	Name     string
+	Token    string
+	Link     string
+	Stages   []StatusStage
+	Timeline string
+	Todo     string
+	Note     string
+}
+
+// StatusPayload ...
+type StatusPayload struct {
+	Requests  []StatusRequest
+	LoggedIn  bool
+	Providers []ProviderInfo
+}
+
+// statusStages are the stages every request goes through in order.
+var statusStages = []struct {
+	status RequestStatus
+	label  string
+}{
+	{StatusSubmitted, "Submitted"},
+	{StatusIdentityVerified, "Identity verified"},
+	{StatusApproved, "Approved"},
+	{StatusProcessing, "Removing logs"},
+	{StatusCompleted, "Done"},
+}
+
+var statusTimelines = map[RequestStatus]string{
+	StatusSubmitted:        "Your request stays here until you verified your identity.",
+	StatusIdentityVerified: "Our support team usually reviews requests within 7 days.",
+	StatusApproved:         "Approved requests are usually processed within 2 days.",
+	StatusProcessing:       "We are removing your logs right now, this usually takes a few minutes.",
+	StatusCompleted:        "Your logs have been removed.",
+	StatusRejected:         "Your request was rejected.",
+	StatusWithdrawn:        "You withdrew this request.",
+}
+
+// statusBroker tells open status streams about transitions of their request.
+type statusBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan RequestStatus]struct{}
+}
+
+func newStatusBroker() *statusBroker {
+	return &statusBroker{subs: make(map[string]map[chan RequestStatus]struct{})}
+}
+
+func (b *statusBroker) subscribe(id string) chan RequestStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan RequestStatus, 1)
+	if b.subs[id] == nil {
+		b.subs[id] = make(map[chan RequestStatus]struct{})
+	}
+	b.subs[id][ch] = struct{}{}
+	return ch
+}
+
+func (b *statusBroker) unsubscribe(id string, ch chan RequestStatus) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs[id], ch)
+	if len(b.subs[id]) == 0 {
+		delete(b.subs, id)
+	}
+}
+
+func (b *statusBroker) publish(id string, status RequestStatus) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[id] {
+		// slow subscribers only need the latest status
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+}
+
+// statusToken signs a link to the status page of a request.
+func (ur *UnRustleLogs) statusToken(id string) (string, error) {
+	return ur.signJWT(&statusClaims{
+		id,
+		ur.standardClaims(statusAudience, time.Now().Add(statusTokenTTL)),
+	})
+}
+
+// parseStatusToken returns the request id of a status link.
+func (ur *UnRustleLogs) parseStatusToken(token string) (string, bool) {
+	claims := &statusClaims{}
+	if err := ur.parseJWT(token, claims, statusAudience); err != nil {
+		return "", false
+	}
+	return claims.Request, true
+}
+
+// statusRequest builds what the status page shows for a request.
+func (ur *UnRustleLogs) statusRequest(r *DeletionRequest) StatusRequest {
+	sr := StatusRequest{
+		Request:  r,
+		Timeline: statusTimelines[r.Status],
+	}
+	if u, ok := ur.GetUser(r.UserID); ok {
+		sr.Service = u.Service
+		sr.Name = u.DisplayName
+	}
+	if token, err := ur.statusToken(r.ID); err == nil {
+		sr.Token = token
+		sr.Link = strings.TrimRight(ur.config.Mail.BaseURL, "/") + "/status?token=" + token
+	}
+
+	reached := -1
+	for i, s := range statusStages {
+		if s.status == r.Status {
+			reached = i
+		}
+	}
+	for i, s := range statusStages {
+		sr.Stages = append(sr.Stages, StatusStage{
+			Label:   s.label,
+			Done:    i <= reached,
+			Current: i == reached,
+		})
+	}
+
+	switch r.Status {
+	case StatusSubmitted:
+		sr.Todo = "Verify your identity by confirming your email address on the " + sr.Service + " page."
+	case StatusRejected:
+		sr.Todo = "If you think this is a mistake reply to our email or write to support@overrustlelogs.net."
+		if history := ur.RequestHistory(r.ID); len(history) > 0 {
+			sr.Note = history[len(history)-1].Note
+		}
+	}
+	return sr
+}
+
+// statusRequests returns the requests the visitor may see, either the one of
+// the signed link or the latest ones of every identity they're logged in with.
+func (ur *UnRustleLogs) statusRequests(c *gin.Context) ([]*DeletionRequest, bool) {
+	if token := c.Query("token"); token != "" {
+		id, ok := ur.parseStatusToken(token)
+		if !ok {
+			return nil, false
+		}
+		r, ok := ur.GetDeletionRequest(id)
+		if !ok {
+			return nil, false
+		}
+		return []*DeletionRequest{r}, true
+	}
+
+	var requests []*DeletionRequest
+	seen := map[string]bool{}
+	loggedIn := false
+	for _, cookie := range ur.providerCookies() {
+		user, ok := ur.getUserFromJWT(c, cookie)
+		if !ok {
+			continue
+		}
+		loggedIn = true
+		// linked identities share their requests
+		if r, ok := ur.LatestDeletionRequest(user.ID); ok && !seen[r.ID] {
+			seen[r.ID] = true
+			requests = append(requests, r)
+		}
+	}
+	return requests, loggedIn
+}
+
+func (ur *UnRustleLogs) statusHandler(c *gin.Context) {
+	requests, ok := ur.statusRequests(c)
+	payload := StatusPayload{LoggedIn: ok, Providers: ur.providerInfos()}
+	for _, r := range requests {
+		payload.Requests = append(payload.Requests, ur.statusRequest(r))
+	}
+	c.HTML(http.StatusOK, "status.tmpl", payload)
+}
+
+// statusEventsHandler streams the status of the request behind the token
+// as server sent events.
+func (ur *UnRustleLogs) statusEventsHandler(c *gin.Context) {
+	id, ok := ur.parseStatusToken(c.Query("token"))
+	if !ok {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	r, ok := ur.GetDeletionRequest(id)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	ch := ur.statusBroker.subscribe(id)
+	defer ur.statusBroker.unsubscribe(id, ch)
+
+	c.Header("Cache-Control", "no-cache")
+	// nginx would buffer the stream otherwise
+	c.Header("X-Accel-Buffering", "no")
+	c.Render(-1, sse.Event{Event: "status", Retry: statusRetry, Data: r.Status})
+	c.Writer.Flush()
+
+	timeout := time.NewTimer(statusStreamDuration)
+	defer timeout.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case status := <-ch:
+			c.SSEvent("status", status)
+			return status.Open()
+		case <-timeout.C:
+			return false
+		}
+	})
+}
@@ -1,34 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/dchest/uniuri"
-	"github.com/sirupsen/logrus"
-
-	"github.com/gin-gonic/gin"
-
-	"github.com/dgrijalva/jwt-go"
 	"github.com/nicklaw5/helix"
 )
 
-// TwitchUser ...
-type TwitchUser struct {
-	ID            string    `json:"_id"`
-	Bio           string    `json:"bio"`
-	CreatedAt     time.Time `json:"created_at"`
-	DisplayName   string    `json:"display_name"`
-	Email         string    `json:"email"`
-	EmailVerified bool      `json:"email_verified"`
-	Logo          string    `json:"logo"`
-	Name          string    `json:"name"`
-	Partnered     bool      `json:"partnered"`
-	Type          string    `json:"type"`
-	UpdatedAt     time.Time `json:"updated_at"`
-}
+const (
+	twitchIssuer   = "https://id.twitch.tv/oauth2"
+	twitchAuthURL  = twitchIssuer + "/authorize"
+	twitchTokenURL = twitchIssuer + "/token"
+	twitchKeysURL  = twitchIssuer + "/keys"
+	// revoking the access token ends the grant, the refresh token included
+	twitchRevokeURL = twitchIssuer + "/revoke"
+	twitchUsersURL  = "https://api.twitch.tv/helix/users"
+)
+
+// twitchClaims asks twitch to put the email into the id_token.
+const twitchClaims = `{"id_token":{"email":null,"email_verified":null}}`
 
 type oauthResponse struct {
 	AccessToken  string   `json:"access_token"`
@@ -38,114 +35,202 @@ type oauthResponse struct {
 	Scope        []string `json:"scope"`
 }
 
-func (ur *UnRustleLogs) setupTwitchClient() (err error) {
-	ur.twitchAPIClient, err = helix.NewClient(&helix.Options{
-		ClientID:     ur.config.Twitch.ClientID,
-		ClientSecret: ur.config.Twitch.ClientSecret,
-		RedirectURI:  ur.config.Twitch.RedirectURL,
-		Scopes:       ur.config.Twitch.Scopes,
-	})
-	return err
+type twitchProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	cookie       string
+	client       *http.Client
+	keys         *jwksCache
 }
 
-func (ur *UnRustleLogs) getUserByOAuthToken(accessToken string) (*TwitchUser, error) {
-	userAPI := "https://api.twitch.tv/kraken/user"
-	req, err := http.NewRequest("GET", userAPI, nil)
-	if err != nil {
-		return nil, err
+func newTwitchProvider(config *Config) (*twitchProvider, error) {
+	scopes := config.Twitch.Scopes
+	hasOpenID := false
+	for _, s := range scopes {
+		hasOpenID = hasOpenID || s == "openid"
+	}
+	if !hasOpenID {
+		// the id_token is where the verified email comes from
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	client := newProviderClient(TWITCHSERVICE)
+	return &twitchProvider{
+		clientID:     config.Twitch.ClientID,
+		clientSecret: config.Twitch.ClientSecret,
+		redirectURL:  config.Twitch.RedirectURL,
+		scopes:       scopes,
+		cookie:       config.Twitch.Cookie,
+		client:       client,
+		keys:         newJWKSCache(twitchKeysURL, client),
+	}, nil
+}
+
+func (p *twitchProvider) Info() ProviderInfo {
+	return ProviderInfo{
+		Service: TWITCHSERVICE,
+		Path:    "/twitch",
+		Title:   "Twitch.tv",
+		Icon:    "fab fa-twitch",
+		Cookie:  p.cookie,
+		Scopes:  p.scopes,
 	}
+}
 
-	req.Header.Add("Authorization", fmt.Sprintf("OAuth %s", accessToken))
-	req.Header.Add("Client-ID", ur.config.Twitch.ClientID)
-	req.Header.Add("Accept", "application/vnd.twitchtv.v5+json")
+func (p *twitchProvider) AuthorizationURL(state string, s *oauthState) (string, error) {
+	s.Nonce = uniuri.NewLen(32)
+	v := url.Values{}
+	v.Set("client_id", p.clientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("response_type", "code")
+	v.Set("scope", strings.Join(p.scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", s.Nonce)
+	v.Set("claims", twitchClaims)
+	v.Set("force_verify", "true")
+	return twitchAuthURL + "?" + v.Encode(), nil
+}
 
-	response, err := ur.twitchHTTPClient.Do(req)
+// Exchange redeems the code by hand, helix drops the id_token.
+func (p *twitchProvider) Exchange(ctx context.Context, code string, s *oauthState) (*Token, error) {
+	form := url.Values{}
+	form.Set("client_id", p.clientID)
+	form.Set("client_secret", p.clientSecret)
+	form.Set("code", code)
+	form.Set("grant_type", "authorization_code")
+	form.Set("redirect_uri", p.redirectURL)
+	req, err := http.NewRequest("POST", twitchTokenURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	var user TwitchUser
-	err = json.NewDecoder(response.Body).Decode(&user)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, providerError(TWITCHSERVICE, "token exchange", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(TWITCHSERVICE, "token exchange", resp); err != nil {
+		return nil, err
+	}
 
-	return &user, err
+	var oauth oauthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&oauth); err != nil {
+		return nil, providerError(TWITCHSERVICE, "token exchange", err)
+	}
+	return &Token{
+		AccessToken:  oauth.AccessToken,
+		RefreshToken: oauth.RefreshToken,
+		IDToken:      oauth.IDToken,
+		ExpiresIn:    oauth.ExpiresIn,
+		Scopes:       oauth.Scope,
+	}, nil
 }
 
-// TwitchLoginHandle ...
-func (ur *UnRustleLogs) TwitchLoginHandle(c *gin.Context) {
-	state := uniuri.New()
-	ur.addTwitchState(state)
-
-	url := ur.twitchAPIClient.GetAuthorizationURL(state, true)
-
-	c.Header("Location", url)
-	c.Redirect(http.StatusFound, url)
+func (p *twitchProvider) Revoke(ctx context.Context, token *Token) error {
+	form := url.Values{}
+	form.Set("client_id", p.clientID)
+	form.Set("token", token.AccessToken)
+	return postForm(ctx, p.client, TWITCHSERVICE, "token revocation", twitchRevokeURL, form)
 }
 
-// TwitchLogoutHandle ...
-func (ur *UnRustleLogs) TwitchLogoutHandle(c *gin.Context) {
-	ur.deleteCookie(c, ur.config.Twitch.Cookie)
-	c.Redirect(http.StatusFound, "/")
-}
+func (p *twitchProvider) Identity(ctx context.Context, token *Token, s *oauthState) (*Identity, error) {
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("twitch returned no id_token, is the openid scope missing?")
+	}
+	claims, err := verifyIDToken(ctx, token.IDToken, p.keys, idTokenCheck{
+		Issuer:   twitchIssuer,
+		Audience: p.clientID,
+		Nonce:    s.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
 
-func (ur *UnRustleLogs) deleteCookie(c *gin.Context, cookie string) {
-	c.SetCookie(cookie, "", -1, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
-}
+	user, err := p.getUser(token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if user.ID != claimString(claims, "sub") {
+		return nil, fmt.Errorf("helix user %s doesn't match id_token subject", user.ID)
+	}
 
-// TwitchCallbackHandle ...
-func (ur *UnRustleLogs) TwitchCallbackHandle(c *gin.Context) {
-	state := c.Query("state")
-	if !ur.hasTwitchState(state) {
-		c.Redirect(http.StatusFound, "/")
-		return
+	identity := &Identity{
+		Service:     TWITCHSERVICE,
+		UserID:      user.ID,
+		Name:        user.Login,
+		DisplayName: user.DisplayName,
+	}
+	created, err := p.getCreatedAt(ctx, token.AccessToken, user.ID)
+	if err != nil {
+		return nil, err
 	}
-	go ur.deleteTwitchState(state)
-	code := c.Query("code")
-	errorMsg := c.Query("error")
-	if errorMsg != "" {
-		c.String(http.StatusBadRequest, errorMsg)
-		return
+	if !created.IsZero() {
+		identity.CreatedAt = &created
 	}
-	if code == "" {
-		c.String(http.StatusUnauthorized, "Authentication failed without error")
-		return
+	// unverified addresses can't prove anything
+	if claimBool(claims, "email_verified") {
+		identity.Email = claimString(claims, "email")
+		identity.EmailVerified = identity.Email != ""
 	}
+	return identity, nil
+}
 
-	oauth, err := ur.twitchAPIClient.GetUserAccessToken(code)
+// getUser returns the user the access token belongs to.
+func (p *twitchProvider) getUser(accessToken string) (*helix.User, error) {
+	// a client per login, SetUserAccessToken would change it for everyone
+	api, err := helix.NewClient(&helix.Options{
+		ClientID:        p.clientID,
+		UserAccessToken: accessToken,
+		HTTPClient:      p.client,
+	})
 	if err != nil {
-		logrus.Error(err)
-		c.String(http.StatusUnauthorized, "Failed to get token from OAuth exchange code")
-		return
+		return nil, err
 	}
-
-	user, err := ur.getUserByOAuthToken(oauth.Data.AccessToken)
+	resp, err := api.GetUsers(&helix.UsersParams{})
 	if err != nil {
-		logrus.Error(err)
-		c.String(http.StatusServiceUnavailable, "Twitch API failure while retrieving user")
-		return
+		return nil, providerError(TWITCHSERVICE, "user lookup", err)
 	}
-
-	id := ur.AddTwitchUser(user)
-	// Set custom claims
-	claims := &jwtClaims{
-		id,
-		jwt.StandardClaims{
-			// 1 month expire
-			ExpiresAt: time.Now().Add((time.Hour * 24) * 31).Unix(),
-		},
+	if resp.StatusCode != http.StatusOK {
+		return nil, &ProviderError{Service: TWITCHSERVICE, Op: "user lookup", Status: resp.StatusCode, Err: errors.New(resp.ErrorMessage)}
+	}
+	if len(resp.Data.Users) != 1 {
+		return nil, providerError(TWITCHSERVICE, "user lookup", fmt.Errorf("%d users returned for the token", len(resp.Data.Users)))
 	}
+	return &resp.Data.Users[0], nil
+}
 
-	// Create token with claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+// getCreatedAt returns when the user was created. helix v0.5.4 doesn't
+// decode created_at, so only that is read from a request of our own.
+func (p *twitchProvider) getCreatedAt(ctx context.Context, accessToken, id string) (time.Time, error) {
+	req, err := http.NewRequest("GET", twitchUsersURL+"?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.Header.Set("Client-Id", p.clientID)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString([]byte(ur.config.Server.JWTSecret))
+	resp, err := p.client.Do(req.WithContext(ctx))
 	if err != nil {
-		logrus.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"message": "failed signing jwt"})
-		return
+		return time.Time{}, providerError(TWITCHSERVICE, "creation date lookup", err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(TWITCHSERVICE, "creation date lookup", resp); err != nil {
+		return time.Time{}, err
 	}
 
-	c.SetCookie(ur.config.Twitch.Cookie, t, 604800, "/", fmt.Sprintf("%s", c.Request.Host), c.Request.URL.Scheme == "https", false)
-	c.Redirect(http.StatusFound, "/twitch")
+	var users struct {
+		Data []struct {
+			ID        string    `json:"id"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return time.Time{}, providerError(TWITCHSERVICE, "creation date lookup", err)
+	}
+	if len(users.Data) != 1 || users.Data[0].ID != id {
+		return time.Time{}, providerError(TWITCHSERVICE, "creation date lookup", fmt.Errorf("user %s wasn't returned", id))
+	}
+	return users.Data[0].CreatedAt.UTC(), nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rewriteTransport sends every request to target instead.
+type rewriteTransport struct{ target *url.URL }
+
+func (rt rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.URL.Scheme, r.URL.Host = rt.target.Scheme, rt.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestTwitchUser(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Client-Id") != "client" || r.Header.Get("Authorization") != "Bearer access" {
+			http.Error(w, `{"error":"Unauthorized","status":401,"message":"Invalid OAuth token"}`, http.StatusUnauthorized)
+			return
+		}
+		switch id := r.URL.Query().Get("id"); id {
+		case "", "141981764":
+			fmt.Fprint(w, `{"data":[{"id":"141981764","login":"twitchdev","display_name":"TwitchDev","created_at":"2016-12-14T20:32:28Z"}]}`)
+		default:
+			fmt.Fprint(w, `{"data":[]}`)
+		}
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+	p := &twitchProvider{clientID: "client", client: &http.Client{Transport: rewriteTransport{target}}}
+
+	user, err := p.getUser("access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != "141981764" || user.Login != "twitchdev" || user.DisplayName != "TwitchDev" {
+		t.Errorf("got user %+v", user)
+	}
+	created, err := p.getCreatedAt(context.Background(), "access", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2016, 12, 14, 20, 32, 28, 0, time.UTC); !created.Equal(want) || created.Location() != time.UTC {
+		t.Errorf("created at %v, want %v", created, want)
+	}
+
+	if _, err := p.getCreatedAt(context.Background(), "access", "1"); err == nil {
+		t.Error("missing user has a creation date")
+	}
+	if _, err := p.getUser("expired"); err == nil {
+		t.Error("invalid token returned a user")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsStandIn is a websocket server that hands every connection to serve
+// after the handshake, a wrong accept key breaks the handshake on purpose.
+func wsStandIn(t *testing.T, accept func(key string) string, serve func(conn net.Conn, br *bufio.Reader)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Sec-WebSocket-Key")
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+			http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept(key))
+		if err := rw.Flush(); err != nil {
+			t.Error(err)
+			return
+		}
+		serve(conn, rw.Reader)
+	}))
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsURL turns the url of an httptest server into a websocket url.
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// serverFrame encodes a frame the way servers send them, unmasked.
+func serverFrame(fin bool, opcode byte, payload []byte) []byte {
+	head := opcode
+	if fin {
+		head |= 0x80
+	}
+	frame := []byte{head}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(n))
+		frame = append(append(frame, 127), ext[:]...)
+	}
+	return append(frame, payload...)
+}
+
+func TestWSHandshake(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept func(string) string
+		ok     bool
+	}{
+		{"valid", wsAccept, true},
+		{"wrong accept key", func(key string) string { return wsAccept(key + "x") }, false},
+		{"missing accept key", func(string) string { return "" }, false},
+	}
+	for _, tt := range tests {
+		srv := wsStandIn(t, tt.accept, func(conn net.Conn, br *bufio.Reader) {
+			conn.Write(serverFrame(true, wsText, []byte("hello")))
+		})
+		conn, err := wsDial(context.Background(), wsURL(srv))
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error is %v, want ok %v", tt.name, err, tt.ok)
+		}
+		if err == nil {
+			if msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+				t.Errorf("%s: read %q, %v", tt.name, msg, err)
+			}
+			conn.Close()
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := wsDial(context.Background(), wsURL(srv)); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("plain http server: error is %v", err)
+	}
+	if _, err := wsDial(context.Background(), srv.URL); err == nil {
+		t.Error("dialed an http url")
+	}
+}
+
+func TestWSReadMessage(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), 300)
+	tests := []struct {
+		name   string
+		frames [][]byte
+		want   []string
+		err    error
+		// pong is what the client has to answer a ping with
+		pong string
+	}{
+		{
+			name:   "text and binary",
+			frames: [][]byte{serverFrame(true, wsText, []byte("one")), serverFrame(true, wsBinary, []byte("two"))},
+			want:   []string{"one", "two"},
+			err:    io.EOF,
+		},
+		{
+			name:   "extended length",
+			frames: [][]byte{serverFrame(true, wsText, long)},
+			want:   []string{string(long)},
+			err:    io.EOF,
+		},
+		{
+			name: "fragments with a ping in between",
+			frames: [][]byte{
+				serverFrame(false, wsText, []byte("MSG {\"nick\":")),
+				serverFrame(true, wsPing, []byte("are you there")),
+				serverFrame(true, wsContinuation, []byte("\"bob\"}")),
+			},
+			want: []string{`MSG {"nick":"bob"}`},
+			err:  io.EOF,
+			pong: "are you there",
+		},
+		{
+			name:   "close frame",
+			frames: [][]byte{serverFrame(true, wsText, []byte("last")), serverFrame(true, wsClose, nil), serverFrame(true, wsText, []byte("never"))},
+			want:   []string{"last"},
+			err:    io.EOF,
+		},
+		{
+			name:   "closed mid frame",
+			frames: [][]byte{serverFrame(true, wsText, []byte("cut off"))[:4]},
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "too big",
+			frames: [][]byte{{0x80 | wsText, 127, 0, 0, 0, 0, 0xff, 0, 0, 0}},
+			err:    errWSMessageTooBig,
+		},
+	}
+	for _, tt := range tests {
+		pong := make(chan string, 1)
+		srv := wsStandIn(t, wsAccept, func(conn net.Conn, br *bufio.Reader) {
+			for _, f := range tt.frames {
+				conn.Write(f)
+				if f[0]&0x0f == wsPing {
+					// clients answer with a masked pong
+					client := &wsConn{br: br}
+					if _, opcode, payload, err := client.readFrame(); err == nil && opcode == wsPong {
+						pong <- string(payload)
+					}
+				}
+			}
+		})
+		conn, err := wsDial(context.Background(), wsURL(srv))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				if err != tt.err {
+					t.Errorf("%s: error is %v, want %v", tt.name, err, tt.err)
+				}
+				break
+			}
+			got = append(got, string(msg))
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.pong != "" {
+			select {
+			case p := <-pong:
+				if p != tt.pong {
+					t.Errorf("%s: pong %q, want %q", tt.name, p, tt.pong)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: no pong", tt.name)
+			}
+		}
+		conn.Close()
+		srv.Close()
+	}
+}